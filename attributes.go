@@ -0,0 +1,373 @@
+package osindynamodb
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/RangelReale/osin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Encoding selects how clients, authorize and access data are stored in DynamoDB items
+type Encoding string
+
+const (
+	// JSONEncoding stores data as json string in json attribute (default)
+	JSONEncoding Encoding = "json"
+	// AttributesEncoding stores data as native DynamoDB attributes (client_id, scope, redirect_uri,
+	// created_at, expires_in, state, ...), so items can be queried and read by other tools.
+	// Items written with either encoding are readable with both, so switching back is safe.
+	// It can't be combined with Encrypter, see ErrEncryptedAttributes.
+	AttributesEncoding Encoding = "attributes"
+)
+
+// ErrEncryptedAttributes is returned by writes if both AttributesEncoding and Encrypter are configured,
+// as native attributes, including client and user data, would be stored in plaintext
+var ErrEncryptedAttributes = errors.New("Encrypter can't be used with AttributesEncoding")
+
+// authorizeRecord lists native attributes of AuthorizeData
+type authorizeRecord struct {
+	Code                string    `dynamodbav:"code,omitempty"`
+	ExpiresIn           int32     `dynamodbav:"expires_in"`
+	Scope               string    `dynamodbav:"scope,omitempty"`
+	RedirectUri         string    `dynamodbav:"redirect_uri,omitempty"`
+	State               string    `dynamodbav:"state,omitempty"`
+	CreatedAt           time.Time `dynamodbav:"created_at"`
+	CodeChallenge       string    `dynamodbav:"code_challenge,omitempty"`
+	CodeChallengeMethod string    `dynamodbav:"code_challenge_method,omitempty"`
+}
+
+// accessRecord lists native attributes of AccessData
+type accessRecord struct {
+	AccessToken  string    `dynamodbav:"access_token,omitempty"`
+	RefreshToken string    `dynamodbav:"refresh_token,omitempty"`
+	ExpiresIn    int32     `dynamodbav:"expires_in"`
+	Scope        string    `dynamodbav:"scope,omitempty"`
+	RedirectUri  string    `dynamodbav:"redirect_uri,omitempty"`
+	CreatedAt    time.Time `dynamodbav:"created_at"`
+}
+
+// usesAttributes reports whether items are written with AttributesEncoding
+func (receiver *Storage) usesAttributes() bool {
+	return receiver.config.Encoding == AttributesEncoding
+}
+
+// checkEncoding returns ErrEncryptedAttributes if items would be written with AttributesEncoding
+// while Encrypter is configured
+func (receiver *Storage) checkEncoding() error {
+	if receiver.usesAttributes() && receiver.config.Encrypter != nil {
+		return ErrEncryptedAttributes
+	}
+	return nil
+}
+
+// encodeAuthorize adds authorizeData to items in configured encoding
+func (receiver *Storage) encodeAuthorize(items map[string]*dynamodb.AttributeValue, authorizeData *osin.AuthorizeData) error {
+	if err := receiver.checkEncoding(); err != nil {
+		return err
+	}
+	authorizeData = receiver.redactAuthorizeData(authorizeData)
+	if !receiver.usesAttributes() {
+		data, err := json.Marshal(authorizeData)
+		if err != nil {
+			return err
+		}
+		items["json"], err = receiver.encodePayload(data, itemPayloadContext(authorizeEntity, items, "json"))
+		return err
+	}
+
+	attributes, err := receiver.authorizeAttributes(authorizeData)
+	if err != nil {
+		return err
+	}
+	for k, v := range attributes {
+		if _, ok := items[k]; !ok {
+			items[k] = v
+		}
+	}
+	return nil
+}
+
+// encodeAccess adds accessData to items of e in configured encoding
+func (receiver *Storage) encodeAccess(items map[string]*dynamodb.AttributeValue, e entity, accessData *osin.AccessData) error {
+	if err := receiver.checkEncoding(); err != nil {
+		return err
+	}
+	accessData = receiver.redactAccessData(accessData)
+	if !receiver.usesAttributes() {
+		data, err := json.Marshal(accessData)
+		if err != nil {
+			return err
+		}
+		items["json"], err = receiver.encodePayload(data, itemPayloadContext(e, items, "json"))
+		return err
+	}
+
+	attributes, err := receiver.accessAttributes(accessData)
+	if err != nil {
+		return err
+	}
+	for k, v := range attributes {
+		if _, ok := items[k]; !ok {
+			items[k] = v
+		}
+	}
+	return nil
+}
+
+// authorizeAttributes converts AuthorizeData to native attributes
+func (receiver *Storage) authorizeAttributes(authorizeData *osin.AuthorizeData) (map[string]*dynamodb.AttributeValue, error) {
+	attributes, err := dynamodbattribute.MarshalMap(authorizeRecord{
+		Code:                authorizeData.Code,
+		ExpiresIn:           authorizeData.ExpiresIn,
+		Scope:               authorizeData.Scope,
+		RedirectUri:         authorizeData.RedirectUri,
+		State:               authorizeData.State,
+		CreatedAt:           authorizeData.CreatedAt,
+		CodeChallenge:       authorizeData.CodeChallenge,
+		CodeChallengeMethod: authorizeData.CodeChallengeMethod,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := receiver.setClientAttributes(attributes, authorizeData.Client); err != nil {
+		return nil, err
+	}
+	if err := setUserDataAttribute(attributes, authorizeData.UserData); err != nil {
+		return nil, err
+	}
+
+	return attributes, nil
+}
+
+// accessAttributes converts AccessData to native attributes
+func (receiver *Storage) accessAttributes(accessData *osin.AccessData) (map[string]*dynamodb.AttributeValue, error) {
+	attributes, err := dynamodbattribute.MarshalMap(accessRecord{
+		AccessToken:  accessData.AccessToken,
+		RefreshToken: accessData.RefreshToken,
+		ExpiresIn:    accessData.ExpiresIn,
+		Scope:        accessData.Scope,
+		RedirectUri:  accessData.RedirectUri,
+		CreatedAt:    accessData.CreatedAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := receiver.setClientAttributes(attributes, accessData.Client); err != nil {
+		return nil, err
+	}
+	if err := setUserDataAttribute(attributes, accessData.UserData); err != nil {
+		return nil, err
+	}
+	if accessData.AuthorizeData != nil {
+		authorizeAttributes, err := receiver.authorizeAttributes(accessData.AuthorizeData)
+		if err != nil {
+			return nil, err
+		}
+		attributes["authorize_data"] = &dynamodb.AttributeValue{M: authorizeAttributes}
+	}
+	if accessData.AccessData != nil {
+		previousAttributes, err := receiver.accessAttributes(accessData.AccessData)
+		if err != nil {
+			return nil, err
+		}
+		attributes["access_data"] = &dynamodb.AttributeValue{M: previousAttributes}
+	}
+
+	return attributes, nil
+}
+
+// setClientAttributes adds client_id and client attributes
+func (receiver *Storage) setClientAttributes(attributes map[string]*dynamodb.AttributeValue, client osin.Client) error {
+	if client == nil {
+		return nil
+	}
+	if hashed, ok := client.(*HashedSecretClient); ok {
+		client = hashed.Client
+	}
+	value, err := dynamodbattribute.Marshal(client)
+	if err != nil {
+		return err
+	}
+	attributes["client"] = value
+	setClientID(attributes, client)
+	return nil
+}
+
+func setUserDataAttribute(attributes map[string]*dynamodb.AttributeValue, userData interface{}) error {
+	if userData == nil {
+		return nil
+	}
+	value, err := dynamodbattribute.Marshal(userData)
+	if err != nil {
+		return err
+	}
+	attributes["user_data"] = value
+	return nil
+}
+
+// authorizeFromAttributes converts native attributes to AuthorizeData
+func (receiver *Storage) authorizeFromAttributes(attributes map[string]*dynamodb.AttributeValue) (*osin.AuthorizeData, error) {
+	var record authorizeRecord
+	if err := dynamodbattribute.UnmarshalMap(attributes, &record); err != nil {
+		return nil, err
+	}
+	authorizeData := &osin.AuthorizeData{
+		Code:                record.Code,
+		ExpiresIn:           record.ExpiresIn,
+		Scope:               record.Scope,
+		RedirectUri:         record.RedirectUri,
+		State:               record.State,
+		CreatedAt:           record.CreatedAt,
+		CodeChallenge:       record.CodeChallenge,
+		CodeChallengeMethod: record.CodeChallengeMethod,
+	}
+
+	var err error
+	if authorizeData.Client, err = receiver.clientFromAttribute(attributes["client"]); err != nil {
+		return nil, err
+	}
+	if value, ok := attributes["user_data"]; ok {
+		if err := dynamodbattribute.Unmarshal(value, &authorizeData.UserData); err != nil {
+			return nil, err
+		}
+	}
+
+	return authorizeData, nil
+}
+
+// accessFromAttributes converts native attributes to AccessData.
+// userData is the struct to which user_data attribute is unmarshaled, if nil generic value is used.
+func (receiver *Storage) accessFromAttributes(attributes map[string]*dynamodb.AttributeValue, userData interface{}) (*osin.AccessData, error) {
+	var record accessRecord
+	if err := dynamodbattribute.UnmarshalMap(attributes, &record); err != nil {
+		return nil, err
+	}
+	accessData := &osin.AccessData{
+		AccessToken:  record.AccessToken,
+		RefreshToken: record.RefreshToken,
+		ExpiresIn:    record.ExpiresIn,
+		Scope:        record.Scope,
+		RedirectUri:  record.RedirectUri,
+		CreatedAt:    record.CreatedAt,
+	}
+
+	var err error
+	if accessData.Client, err = receiver.clientFromAttribute(attributes["client"]); err != nil {
+		return nil, err
+	}
+	if value, ok := attributes["user_data"]; ok {
+		if userData != nil {
+			err = dynamodbattribute.Unmarshal(value, userData)
+			accessData.UserData = userData
+		} else {
+			err = dynamodbattribute.Unmarshal(value, &accessData.UserData)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := attributes["authorize_data"]; ok && value.M != nil {
+		if accessData.AuthorizeData, err = receiver.authorizeFromAttributes(value.M); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := attributes["access_data"]; ok && value.M != nil {
+		if accessData.AccessData, err = receiver.accessFromAttributes(value.M, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return accessData, nil
+}
+
+// clientFromAttribute converts client attribute to client created by StorageConfig.CreateClient
+func (receiver *Storage) clientFromAttribute(value *dynamodb.AttributeValue) (osin.Client, error) {
+	if value == nil || value.M == nil {
+		return nil, nil
+	}
+	client := receiver.newClient()
+	if err := dynamodbattribute.UnmarshalMap(value.M, client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// authorizeAttributeNames lists attributes of authorize table items written in any encoding
+var authorizeAttributeNames = []string{
+	"json", "code", "expires_in", "scope", "redirect_uri", "state", "created_at",
+	"code_challenge", "code_challenge_method", "client", "user_data",
+}
+
+// accessAttributeNames lists attributes of access and refresh table items written in any encoding
+var accessAttributeNames = []string{
+	"json", "token", "access_token", "refresh_token", "expires_in", "scope", "redirect_uri", "created_at",
+	"client", "user_data", "authorize_data", "access_data",
+}
+
+// authorizeProjection returns projection expression of authorize table items and its expression attribute names.
+// Both encodings are projected, so items written with either of them can be decoded.
+func (receiver *Storage) authorizeProjection() (*string, map[string]*string) {
+	return projection(authorizeAttributeNames...)
+}
+
+// projection returns projection expression of attributes and its expression attribute names.
+// All attribute names are aliased as many of them are reserved words (e.g. family, token).
+func projection(attributes ...string) (*string, map[string]*string) {
+	aliases := make([]string, 0, len(attributes))
+	names := make(map[string]*string, len(attributes))
+	for _, attribute := range attributes {
+		alias := "#" + attribute
+		aliases = append(aliases, alias)
+		names[alias] = aws.String(attribute)
+	}
+	return aws.String(strings.Join(aliases, ", ")), names
+}
+
+// encodeClient adds client to client table item in configured encoding.
+// Secret is left out if item has secret_hash attribute.
+func (receiver *Storage) encodeClient(items map[string]*dynamodb.AttributeValue, client osin.Client) error {
+	if err := receiver.checkEncoding(); err != nil {
+		return err
+	}
+	_, hashed := items["secret_hash"]
+	if !receiver.usesAttributes() {
+		data, err := json.Marshal(client)
+		if err != nil {
+			return err
+		}
+		if hashed {
+			if data, err = removeClientSecret(data); err != nil {
+				return err
+			}
+		}
+		items["json"], err = receiver.encodePayload(data, itemPayloadContext(clientEntity, items, "json"))
+		return err
+	}
+
+	value, err := dynamodbattribute.Marshal(client)
+	if err != nil {
+		return err
+	}
+	if hashed && value.M != nil {
+		delete(value.M, "Secret")
+	}
+	items["client"] = value
+	return nil
+}
+
+// clientPayload returns json marshaled client of client table item written in any encoding
+func (receiver *Storage) clientPayload(item map[string]*dynamodb.AttributeValue) ([]byte, error) {
+	if _, ok := item["json"]; ok || item["client"] == nil {
+		return receiver.decodePayload(item["json"], itemPayloadContext(clientEntity, item, "json"))
+	}
+	client, err := receiver.clientFromAttribute(item["client"])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(client)
+}
@@ -0,0 +1,444 @@
+package osindynamodb
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/RangelReale/osin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+var (
+	// ErrInvalidPageToken is returned by ListClients if page token is malformed
+	ErrInvalidPageToken = errors.New("Invalid page token")
+	// ErrVersionConflict is returned by UpdateClient if client was modified since it was read
+	ErrVersionConflict = errors.New("Version conflict")
+)
+
+// clientProjection lists attributes of client table needed to decode client
+const clientProjection = "#id, #json, #client, #secret_hash, #secret, #redirect_uri, #user_data, #version"
+
+// clientUpdateFields maps attributes written by UpdateClient to fields of json marshaled client they replace
+var clientUpdateFields = map[string]string{
+	"secret":       "Secret",
+	"redirect_uri": "RedirectUri",
+	"user_data":    "UserData",
+}
+
+// ClientUpdate lists client fields changed by UpdateClient, nil fields are left untouched
+type ClientUpdate struct {
+	// Secret replaces client secret
+	Secret *string
+	// RedirectUri replaces client redirect uri
+	RedirectUri *string
+	// UserData replaces client user data
+	UserData interface{}
+}
+
+// GetClientWithVersion loads the client by id (client_id) together with its version used by UpdateClient.
+// Clients created before versioning was introduced have version 0.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) GetClientWithVersion(id string) (osin.Client, int64, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.GetClientWithVersionWithContext(ctx, id)
+}
+
+// GetClientWithVersionWithContext is the same as GetClientWithVersion with the ability to pass a context.
+func (receiver *Storage) GetClientWithVersionWithContext(ctx context.Context, id string) (osin.Client, int64, error) {
+	params := &dynamodb.GetItemInput{
+		Key:                      receiver.itemKey(clientEntity, id),
+		ProjectionExpression:     aws.String(clientProjection),
+		ExpressionAttributeNames: clientProjectionNames(),
+		TableName:                receiver.tableName(clientEntity),
+	}
+
+	resp, err := receiver.db.GetItemWithContext(ctx, params)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(resp.Item) == 0 {
+		return nil, 0, ErrClientNotFound
+	}
+
+	client, err := receiver.decodeClient(resp.Item)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := clientVersion(resp.Item)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return client, version, nil
+}
+
+// UpdateClient changes selected fields of the client if its version still equals version
+// and returns the new version. ErrVersionConflict is returned if the client was modified in the meantime.
+// Only changed fields are written, json attribute is left untouched unless the secret is hashed
+// with HashClientSecrets, then its plaintext secret is removed. With AttributesEncoding the fields
+// of client attribute are changed in place.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) UpdateClient(id string, version int64, update ClientUpdate) (int64, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.UpdateClientWithContext(ctx, id, version, update)
+}
+
+// UpdateClientWithContext is the same as UpdateClient with the ability to pass a context.
+func (receiver *Storage) UpdateClientWithContext(ctx context.Context, id string, version int64, update ClientUpdate) (int64, error) {
+	if err := receiver.checkEncoding(); err != nil {
+		return 0, err
+	}
+	next, err := receiver.updateClient(ctx, id, version, update, receiver.usesAttributes())
+	if err == errClientNotInAttributes {
+		// client was written with json encoding, fields are written next to it
+		return receiver.updateClient(ctx, id, version, update, false)
+	}
+	return next, err
+}
+
+// errClientNotInAttributes is returned by updateClient if client attribute to update in place is missing
+var errClientNotInAttributes = errors.New("Client not in attributes")
+
+// updateClient writes fields of update to client attribute if inPlace is true, otherwise next to json attribute
+func (receiver *Storage) updateClient(ctx context.Context, id string, version int64, update ClientUpdate, inPlace bool) (int64, error) {
+	names := map[string]*string{
+		"#version": aws.String("version"),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":next": {
+			N: aws.String(strconv.FormatInt(version+1, 10)),
+		},
+	}
+	updateExpression := "SET #version = :next"
+	set := func(attribute string, value *dynamodb.AttributeValue) {
+		names["#"+attribute] = aws.String(attribute)
+		values[":"+attribute] = value
+		updateExpression += ", #" + attribute + " = :" + attribute
+	}
+	var removed []string
+	remove := func(attribute string) {
+		names["#"+attribute] = aws.String(attribute)
+		removed = append(removed, "#"+attribute)
+	}
+	// field returns path of client attribute field replaced by attribute
+	field := func(attribute string) string {
+		field := clientUpdateFields[attribute]
+		names["#client"] = aws.String("client")
+		names["#"+field] = aws.String(field)
+		return "#client.#" + field
+	}
+	write := func(attribute string, value interface{}) error {
+		if !inPlace {
+			encoded, err := receiver.encodeClientUpdate(id, attribute, value)
+			if err != nil {
+				return err
+			}
+			set(attribute, encoded)
+			return nil
+		}
+		encoded, err := dynamodbattribute.Marshal(value)
+		if err != nil {
+			return err
+		}
+		values[":"+attribute] = encoded
+		updateExpression += ", " + field(attribute) + " = :" + attribute
+		// values written before by UpdateClient would override the field
+		remove(attribute)
+		return nil
+	}
+
+	if update.Secret != nil {
+		if receiver.config.HashClientSecrets {
+			secretHash, err := receiver.hashClientSecret(*update.Secret)
+			if err != nil {
+				return 0, err
+			}
+			set("secret_hash", &dynamodb.AttributeValue{
+				S: aws.String(secretHash),
+			})
+			remove("secret")
+			stored, err := receiver.clientWithoutSecret(ctx, id)
+			if err != nil {
+				return 0, err
+			}
+			if stored["json"] != nil {
+				set("json", stored["json"])
+			}
+			if inPlace || stored["client"] != nil {
+				removed = append(removed, field("secret"))
+			}
+		} else {
+			if err := write("secret", *update.Secret); err != nil {
+				return 0, err
+			}
+			remove("secret_hash")
+		}
+	}
+	if update.RedirectUri != nil {
+		if err := write("redirect_uri", *update.RedirectUri); err != nil {
+			return 0, err
+		}
+	}
+	if update.UserData != nil {
+		if err := write("user_data", update.UserData); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(removed) > 0 {
+		updateExpression += " REMOVE " + strings.Join(removed, ", ")
+	}
+
+	condition := "attribute_exists(#id) AND #version = :version"
+	if version == 0 {
+		condition = "attribute_exists(#id) AND attribute_not_exists(#version)"
+	} else {
+		values[":version"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(version, 10)),
+		}
+	}
+	if inPlace {
+		names["#client"] = aws.String("client")
+		condition += " AND attribute_exists(#client)"
+	}
+	names["#id"] = aws.String("id")
+
+	params := &dynamodb.UpdateItemInput{
+		Key:                       receiver.itemKey(clientEntity, id),
+		ConditionExpression:       aws.String(condition),
+		UpdateExpression:          aws.String(updateExpression),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		TableName:                 receiver.tableName(clientEntity),
+	}
+
+	_, err := receiver.db.UpdateItemWithContext(ctx, params)
+	if isConditionalCheckFailed(err) {
+		_, current, getErr := receiver.GetClientWithVersionWithContext(ctx, id)
+		if getErr == ErrClientNotFound {
+			return 0, ErrClientNotFound
+		}
+		if getErr == nil && inPlace && current == version {
+			return 0, errClientNotInAttributes
+		}
+		return 0, ErrVersionConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return version + 1, nil
+}
+
+// clientWithoutSecret returns json attribute of client id re-encoded without plaintext secret
+// together with client attribute if client has it, so UpdateClient can drop the secret when it's hashed
+func (receiver *Storage) clientWithoutSecret(ctx context.Context, id string) (map[string]*dynamodb.AttributeValue, error) {
+	resp, err := receiver.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:                  receiver.itemKey(clientEntity, id),
+		ProjectionExpression: aws.String("#json, #client"),
+		ExpressionAttributeNames: map[string]*string{
+			"#json":   aws.String("json"),
+			"#client": aws.String("client"),
+		},
+		TableName: receiver.tableName(clientEntity),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Item) == 0 {
+		return nil, ErrClientNotFound
+	}
+	if resp.Item["json"] == nil {
+		return resp.Item, nil
+	}
+
+	context := payloadContext(clientEntity, id, "json")
+	data, err := receiver.decodePayload(resp.Item["json"], context)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = removeClientSecret(data); err != nil {
+		return nil, err
+	}
+	if resp.Item["json"], err = receiver.encodePayload(data, context); err != nil {
+		return nil, err
+	}
+	return resp.Item, nil
+}
+
+// encodeClientUpdate returns value of attribute of client id written by UpdateClient
+func (receiver *Storage) encodeClientUpdate(id string, attribute string, value interface{}) (*dynamodb.AttributeValue, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return receiver.encodePayload(data, payloadContext(clientEntity, id, attribute))
+}
+
+// applyClientUpdates replaces fields of json marshaled client with values written by UpdateClient.
+// Secret is removed if client has secret_hash attribute.
+func (receiver *Storage) applyClientUpdates(data []byte, item map[string]*dynamodb.AttributeValue) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	// secret is verified with hash, see HashedSecretClient
+	_, hashed := item["secret_hash"]
+	if hashed {
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		delete(fields, "Secret")
+	}
+	for attribute, field := range clientUpdateFields {
+		value, ok := item[attribute]
+		if !ok {
+			continue
+		}
+		if fields == nil {
+			if err := json.Unmarshal(data, &fields); err != nil {
+				return nil, err
+			}
+		}
+		fieldData, err := receiver.decodePayload(value, itemPayloadContext(clientEntity, item, attribute))
+		if err != nil {
+			return nil, err
+		}
+		if field != "Secret" || !hashed {
+			fields[field] = json.RawMessage(fieldData)
+		}
+	}
+	if fields == nil {
+		return data, nil
+	}
+
+	return json.Marshal(fields)
+}
+
+// clientVersion returns value of version attribute, 0 if it's missing
+func clientVersion(item map[string]*dynamodb.AttributeValue) (int64, error) {
+	value, ok := item["version"]
+	if !ok || value.N == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(*value.N, 10, 64)
+}
+
+// clientProjectionNames returns expression attribute names used by clientProjection
+func clientProjectionNames() map[string]*string {
+	return map[string]*string{
+		"#id":           aws.String("id"),
+		"#json":         aws.String("json"),
+		"#client":       aws.String("client"),
+		"#secret_hash":  aws.String("secret_hash"),
+		"#secret":       aws.String("secret"),
+		"#redirect_uri": aws.String("redirect_uri"),
+		"#user_data":    aws.String("user_data"),
+		"#version":      aws.String("version"),
+	}
+}
+
+// ClientFilter reports whether client should be returned by ListClients
+type ClientFilter func(client osin.Client) bool
+
+// ListClients lists clients page by page.
+// Pass empty pageToken to get the first page and returned page token to get the next one,
+// empty page token is returned with the last page. Limit is the number of items evaluated per page,
+// so a page can have less clients, especially when filters or SingleTable are used.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) ListClients(pageToken string, limit int64, filters ...ClientFilter) ([]osin.Client, string, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.ListClientsWithContext(ctx, pageToken, limit, filters...)
+}
+
+// ListClientsWithContext is the same as ListClients with the ability to pass a context.
+func (receiver *Storage) ListClientsWithContext(ctx context.Context, pageToken string, limit int64, filters ...ClientFilter) ([]osin.Client, string, error) {
+	params := &dynamodb.ScanInput{
+		ProjectionExpression:     aws.String(clientProjection),
+		ExpressionAttributeNames: clientProjectionNames(),
+		TableName:                receiver.tableName(clientEntity),
+	}
+	if receiver.usesSingleTable() {
+		params.FilterExpression = aws.String("#sk = :sk")
+		params.ExpressionAttributeNames["#sk"] = aws.String("sk")
+		params.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":sk": {
+				S: aws.String(clientEntity.prefix),
+			},
+		}
+	}
+	if limit > 0 {
+		params.Limit = aws.Int64(limit)
+	}
+	if pageToken != "" {
+		startKey, err := decodePageToken(pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		params.ExclusiveStartKey = startKey
+	}
+
+	resp, err := receiver.db.ScanWithContext(ctx, params)
+	if err != nil {
+		return nil, "", err
+	}
+
+	clients := make([]osin.Client, 0, len(resp.Items))
+	for _, item := range resp.Items {
+		client, err := receiver.decodeClient(item)
+		if err != nil {
+			return nil, "", err
+		}
+		if matchesClientFilters(client, filters) {
+			clients = append(clients, client)
+		}
+	}
+
+	nextPageToken, err := encodePageToken(resp.LastEvaluatedKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return clients, nextPageToken, nil
+}
+
+func matchesClientFilters(client osin.Client, filters []ClientFilter) bool {
+	for _, filter := range filters {
+		if !filter(client) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodePageToken converts LastEvaluatedKey to opaque page token
+func encodePageToken(key map[string]*dynamodb.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodePageToken converts page token back to ExclusiveStartKey
+func decodePageToken(pageToken string) (map[string]*dynamodb.AttributeValue, error) {
+	data, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	var key map[string]*dynamodb.AttributeValue
+	if err := json.Unmarshal(data, &key); err != nil || len(key) == 0 {
+		return nil, ErrInvalidPageToken
+	}
+	return key, nil
+}
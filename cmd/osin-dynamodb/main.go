@@ -0,0 +1,397 @@
+// Command osin-dynamodb manages schema, clients and tokens of osin-dynamodb tables.
+//
+// Usage:
+//
+//	osin-dynamodb [global flags] schema create|verify|drop
+//	osin-dynamodb [global flags] client create|get|update -id ID [-secret-stdin] [-redirect-uri URI]
+//	osin-dynamodb [global flags] client list
+//	osin-dynamodb [global flags] client remove -id ID
+//	osin-dynamodb [global flags] token inspect|revoke -type access|refresh|authorize [-token-stdin]
+//	osin-dynamodb [global flags] token revoke-by-client -client ID
+//	osin-dynamodb [global flags] token revoke-by-user -user ID
+//
+// Global flags select tables the same way as StorageConfig, e.g. -prefix is passed to CreateStorageConfig
+// and -endpoint allows to use DynamoDB Local (-endpoint http://localhost:4567). They must match
+// StorageConfig of the application, otherwise encrypted items can't be read and revoked refresh tokens
+// are deleted instead of being kept for reuse detection.
+// Tables are created by schema create with TableOptions given by -billing-mode, -read-capacity,
+// -write-capacity, -sse, -kms-key-id and -point-in-time-recovery, e.g. -billing-mode PAY_PER_REQUEST -sse.
+//
+// Secrets are never passed as flags, so they don't end up in shell history or process list:
+// client secret is read from stdin with -secret-stdin or from OSIN_DYNAMODB_CLIENT_SECRET,
+// token or authorization code from stdin with -token-stdin or from OSIN_DYNAMODB_TOKEN,
+// token pepper from OSIN_DYNAMODB_TOKEN_PEPPER and encryption keys from OSIN_DYNAMODB_ENCRYPTION_KEYS
+// as comma separated id:base64-key pairs, the first key is used for encryption.
+// Client secrets are left out of client get and client list output.
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/RangelReale/osin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/uniplaces/osin-dynamodb"
+)
+
+var (
+	errUsage                 = errors.New("Invalid usage, run with -h for help")
+	errInvalidEncryptionKeys = errors.New("OSIN_DYNAMODB_ENCRYPTION_KEYS must be comma separated id:base64-key pairs")
+)
+
+// environment is the process environment used by run
+type environment struct {
+	in     io.Reader
+	out    io.Writer
+	getenv func(key string) string
+	// newDB returns DynamoDB client configured by awsConfig
+	newDB func(awsConfig *aws.Config) (dynamodbiface.DynamoDBAPI, error)
+}
+
+func main() {
+	env := environment{
+		in:     os.Stdin,
+		out:    os.Stdout,
+		getenv: os.Getenv,
+		newDB: func(awsConfig *aws.Config) (dynamodbiface.DynamoDBAPI, error) {
+			sess, err := session.NewSession(awsConfig)
+			if err != nil {
+				return nil, err
+			}
+			return dynamodb.New(sess), nil
+		},
+	}
+	if err := run(os.Args[1:], env); err != nil && err != flag.ErrHelp {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run executes command given by args in env
+func run(args []string, env environment) error {
+	flags := flag.NewFlagSet("osin-dynamodb", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "table name prefix passed to CreateStorageConfig")
+	singleTable := flags.String("single-table", "", "name of single table, overrides -prefix")
+	endpoint := flags.String("endpoint", "", "DynamoDB endpoint override, e.g. http://localhost:4567")
+	region := flags.String("region", "", "AWS region, if empty it's taken from environment")
+	userIDAttribute := flags.String("user-id-attribute", "", "attribute identifying the user, see StorageConfig.UserIDAttribute")
+	hashTokens := flags.Bool("hash-tokens", false, "tokens are stored hashed, see StorageConfig.HashTokens; pepper is read from OSIN_DYNAMODB_TOKEN_PEPPER")
+	hashClientSecrets := flags.Bool("hash-client-secrets", false, "client secrets are stored hashed, see StorageConfig.HashClientSecrets")
+	encoding := flags.String("encoding", "", "json or attributes, see StorageConfig.Encoding")
+	ttlAttribute := flags.String("ttl-attribute", "", "Time To Live attribute, see StorageConfig.TTLAttribute")
+	refreshTokenLifetime := flags.Duration("refresh-token-lifetime", 0, "see StorageConfig.RefreshTokenLifetime")
+	refreshTokenIdleLifetime := flags.Duration("refresh-token-idle-lifetime", 0, "see StorageConfig.RefreshTokenIdleLifetime")
+	refreshTokenRotation := flags.Bool("refresh-token-rotation", false, "revoked refresh tokens are kept for reuse detection, see StorageConfig.RefreshTokenRotation")
+	rotatedRefreshTokenLifetime := flags.Duration("rotated-refresh-token-lifetime", 0, "see StorageConfig.RotatedRefreshTokenLifetime")
+	consumeAuthorizeOnLoad := flags.Bool("consume-authorize-on-load", false, "see StorageConfig.ConsumeAuthorizeOnLoad")
+	cascadeRemoveClient := flags.Bool("cascade-remove-client", false, "client remove revokes tokens of the client, see StorageConfig.CascadeRemoveClient")
+	billingMode := flags.String("billing-mode", "", "PROVISIONED or PAY_PER_REQUEST billing of created tables, see TableOptions.BillingMode")
+	readCapacityUnits := flags.Int64("read-capacity", 0, "read capacity units of created tables and indexes in provisioned mode")
+	writeCapacityUnits := flags.Int64("write-capacity", 0, "write capacity units of created tables and indexes in provisioned mode")
+	sse := flags.Bool("sse", false, "create tables with server-side encryption with AWS KMS")
+	kmsKeyID := flags.String("kms-key-id", "", "id, ARN or alias of KMS key used with -sse, if empty AWS managed key is used")
+	pointInTimeRecovery := flags.Bool("point-in-time-recovery", false, "enable point in time recovery of created tables")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: osin-dynamodb [global flags] schema|client|token command [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return errUsage
+	}
+
+	config := osindynamodb.CreateStorageConfig(*prefix)
+	config.SingleTable = *singleTable
+	config.UserIDAttribute = *userIDAttribute
+	config.HashTokens = *hashTokens
+	config.TokenPepper = []byte(env.getenv("OSIN_DYNAMODB_TOKEN_PEPPER"))
+	config.HashClientSecrets = *hashClientSecrets
+	config.Encoding = osindynamodb.Encoding(*encoding)
+	config.TTLAttribute = *ttlAttribute
+	config.RefreshTokenLifetime = *refreshTokenLifetime
+	config.RefreshTokenIdleLifetime = *refreshTokenIdleLifetime
+	config.RefreshTokenRotation = *refreshTokenRotation
+	config.RotatedRefreshTokenLifetime = *rotatedRefreshTokenLifetime
+	config.ConsumeAuthorizeOnLoad = *consumeAuthorizeOnLoad
+	config.CascadeRemoveClient = *cascadeRemoveClient
+	config.TableOptions = osindynamodb.TableOptions{
+		BillingMode:         *billingMode,
+		ReadCapacityUnits:   *readCapacityUnits,
+		WriteCapacityUnits:  *writeCapacityUnits,
+		SSE:                 *sse,
+		KMSMasterKeyID:      *kmsKeyID,
+		PointInTimeRecovery: *pointInTimeRecovery,
+	}
+	if keys := env.getenv("OSIN_DYNAMODB_ENCRYPTION_KEYS"); keys != "" {
+		keyring, err := parseKeyring(keys)
+		if err != nil {
+			return err
+		}
+		config.Encrypter = keyring
+	}
+
+	awsConfig := &aws.Config{}
+	if *endpoint != "" {
+		awsConfig.Endpoint = endpoint
+	}
+	if *region != "" {
+		awsConfig.Region = region
+	}
+	db, err := env.newDB(awsConfig)
+	if err != nil {
+		return err
+	}
+	storage := osindynamodb.New(db, config)
+
+	group, command, commandArgs := flags.Arg(0), flags.Arg(1), flags.Args()[2:]
+	switch group {
+	case "schema":
+		return runSchema(storage, command, env)
+	case "client":
+		return runClient(storage, command, commandArgs, env)
+	case "token":
+		return runToken(storage, command, commandArgs, env)
+	}
+
+	flags.Usage()
+	return errUsage
+}
+
+// parseKeyring returns AESGCMKeyring of comma separated id:base64-key pairs encrypting with the first key
+func parseKeyring(value string) (*osindynamodb.AESGCMKeyring, error) {
+	var currentKeyID string
+	keys := map[string][]byte{}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, errInvalidEncryptionKeys
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errInvalidEncryptionKeys
+		}
+		if currentKeyID == "" {
+			currentKeyID = parts[0]
+		}
+		keys[parts[0]] = key
+	}
+	return osindynamodb.NewAESGCMKeyring(currentKeyID, keys)
+}
+
+func runSchema(storage *osindynamodb.Storage, command string, env environment) error {
+	switch command {
+	case "create":
+		changes, err := storage.EnsureSchema(false)
+		for _, change := range changes {
+			if err := writeJSON(env.out, change); err != nil {
+				return err
+			}
+		}
+		return err
+	case "drop":
+		return storage.DropSchema()
+	case "verify":
+		report, err := storage.Verify()
+		if err != nil {
+			return err
+		}
+		if err := writeJSON(env.out, report); err != nil {
+			return err
+		}
+		if !report.OK() {
+			return errors.New("Schema verification failed")
+		}
+		return nil
+	}
+
+	return errUsage
+}
+
+func runClient(storage *osindynamodb.Storage, command string, args []string, env environment) error {
+	flags := flag.NewFlagSet("client "+command, flag.ContinueOnError)
+	id := flags.String("id", "", "client id")
+	secretStdin := flags.Bool("secret-stdin", false, "read client secret from the first line of stdin instead of OSIN_DYNAMODB_CLIENT_SECRET")
+	redirectURI := flags.String("redirect-uri", "", "client redirect uri")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" && command != "list" {
+		flags.Usage()
+		return errUsage
+	}
+	secret, err := readSecret(*secretStdin, "OSIN_DYNAMODB_CLIENT_SECRET", env)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "create":
+		return storage.CreateClient(&osin.DefaultClient{
+			Id:          *id,
+			Secret:      aws.StringValue(secret),
+			RedirectUri: *redirectURI,
+		})
+	case "get":
+		client, err := storage.GetClient(*id)
+		if err != nil {
+			return err
+		}
+		return writeClient(env.out, client)
+	case "list":
+		pageToken := ""
+		for {
+			clients, nextPageToken, err := storage.ListClients(pageToken, 100)
+			if err != nil {
+				return err
+			}
+			for _, client := range clients {
+				if err := writeClient(env.out, client); err != nil {
+					return err
+				}
+			}
+			if nextPageToken == "" {
+				return nil
+			}
+			pageToken = nextPageToken
+		}
+	case "update":
+		_, version, err := storage.GetClientWithVersion(*id)
+		if err != nil {
+			return err
+		}
+		update := osindynamodb.ClientUpdate{
+			Secret: secret,
+		}
+		flags.Visit(func(f *flag.Flag) {
+			if f.Name == "redirect-uri" {
+				update.RedirectUri = redirectURI
+			}
+		})
+		_, err = storage.UpdateClient(*id, version, update)
+		return err
+	case "remove":
+		return storage.RemoveClient(*id)
+	}
+
+	return errUsage
+}
+
+// readSecret returns secret read from the first line of stdin if fromStdin is true,
+// otherwise from environment variable. Nil is returned if secret isn't given.
+func readSecret(fromStdin bool, variable string, env environment) (*string, error) {
+	if !fromStdin {
+		if secret := env.getenv(variable); secret != "" {
+			return &secret, nil
+		}
+		return nil, nil
+	}
+	secret, err := bufio.NewReader(env.in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+	return &secret, nil
+}
+
+func runToken(storage *osindynamodb.Storage, command string, args []string, env environment) error {
+	flags := flag.NewFlagSet("token "+command, flag.ContinueOnError)
+	tokenType := flags.String("type", "access", "token type: access, refresh or authorize")
+	tokenStdin := flags.Bool("token-stdin", false, "read token or authorization code from the first line of stdin instead of OSIN_DYNAMODB_TOKEN")
+	clientID := flags.String("client", "", "client id")
+	userID := flags.String("user", "", "user id, requires -user-id-attribute")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	token, err := readSecret(*tokenStdin, "OSIN_DYNAMODB_TOKEN", env)
+	if err != nil {
+		return err
+	}
+	value := aws.StringValue(token)
+
+	switch command {
+	case "inspect":
+		if value == "" {
+			flags.Usage()
+			return errUsage
+		}
+		var data interface{}
+		switch *tokenType {
+		case "access":
+			data, err = storage.InspectAccess(value)
+		case "refresh":
+			data, err = storage.InspectRefresh(value)
+		case "authorize":
+			data, err = storage.InspectAuthorize(value)
+		default:
+			return errUsage
+		}
+		if err != nil {
+			return err
+		}
+		return writeJSON(env.out, data)
+	case "revoke":
+		if value == "" {
+			flags.Usage()
+			return errUsage
+		}
+		switch *tokenType {
+		case "access":
+			return storage.RemoveAccess(value)
+		case "refresh":
+			return storage.RemoveRefresh(value)
+		case "authorize":
+			return storage.RemoveAuthorize(value)
+		}
+		return errUsage
+	case "revoke-by-client":
+		if *clientID == "" {
+			flags.Usage()
+			return errUsage
+		}
+		return storage.RevokeClientTokens(*clientID)
+	case "revoke-by-user":
+		if *userID == "" {
+			flags.Usage()
+			return errUsage
+		}
+		return storage.RevokeUserTokens(*userID)
+	}
+
+	return errUsage
+}
+
+// writeClient writes client as JSON without its secret
+func writeClient(out io.Writer, client osin.Client) error {
+	data, err := json.Marshal(client)
+	if err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	delete(fields, "Secret")
+	return writeJSON(out, fields)
+}
+
+func writeJSON(out io.Writer, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
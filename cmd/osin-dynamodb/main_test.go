@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RangelReale/osin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/uniplaces/osin-dynamodb"
+	"github.com/uniplaces/osin-dynamodb/fakedynamodb"
+)
+
+// testEnvironment returns environment using db with stdin in and environment variables variables
+func testEnvironment(db dynamodbiface.DynamoDBAPI, in string, variables map[string]string) (environment, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return environment{
+		in:  strings.NewReader(in),
+		out: out,
+		getenv: func(key string) string {
+			return variables[key]
+		},
+		newDB: func(awsConfig *aws.Config) (dynamodbiface.DynamoDBAPI, error) {
+			return db, nil
+		},
+	}, out
+}
+
+func TestSchemaAndClient(t *testing.T) {
+	t.Parallel()
+	db := fakedynamodb.New()
+	env, out := testEnvironment(db, "", nil)
+	err := run([]string{"-prefix", "SchemaAndClient", "schema", "create"}, env)
+	assert.Nil(t, err, "%s", err)
+	assert.Contains(t, out.String(), `"Action":"CreateTable"`)
+
+	// existing schema is left untouched
+	env, out = testEnvironment(db, "", nil)
+	err = run([]string{"-prefix", "SchemaAndClient", "schema", "create"}, env)
+	assert.Nil(t, err, "%s", err)
+	assert.Empty(t, out.String())
+	env, out = testEnvironment(db, "", nil)
+	err = run([]string{"-prefix", "SchemaAndClient", "schema", "verify"}, env)
+	assert.Nil(t, err, "%s", err)
+
+	env, _ = testEnvironment(db, "aabbccdd\n", nil)
+	err = run([]string{"-prefix", "SchemaAndClient", "client", "create", "-id", "1234", "-secret-stdin", "-redirect-uri", "/dev/null"}, env)
+	assert.Nil(t, err, "%s", err)
+	env, out = testEnvironment(db, "", nil)
+	err = run([]string{"-prefix", "SchemaAndClient", "client", "get", "-id", "1234"}, env)
+	assert.Nil(t, err, "%s", err)
+	assert.JSONEq(t, `{"Id":"1234","RedirectUri":"/dev/null","UserData":null}`, out.String())
+	storage := osindynamodb.New(db, osindynamodb.CreateStorageConfig("SchemaAndClient"))
+	client, err := storage.GetClient("1234")
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, "aabbccdd", client.GetSecret())
+
+	env, _ = testEnvironment(db, "", map[string]string{"OSIN_DYNAMODB_CLIENT_SECRET": "eeff"})
+	err = run([]string{"-prefix", "SchemaAndClient", "client", "update", "-id", "1234"}, env)
+	assert.Nil(t, err, "%s", err)
+	env, out = testEnvironment(db, "", nil)
+	err = run([]string{"-prefix", "SchemaAndClient", "client", "list"}, env)
+	assert.Nil(t, err, "%s", err)
+	assert.JSONEq(t, `{"Id":"1234","RedirectUri":"/dev/null","UserData":null}`, out.String())
+	client, err = storage.GetClient("1234")
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, "eeff", client.GetSecret())
+
+	err = storage.SaveAccess(&osin.AccessData{
+		Client:      &osin.DefaultClient{Id: "1234"},
+		AccessToken: "1",
+		ExpiresIn:   3600,
+		CreatedAt:   time.Now(),
+	})
+	assert.Nil(t, err, "%s", err)
+	env, _ = testEnvironment(db, "", nil)
+	err = run([]string{"-prefix", "SchemaAndClient", "-cascade-remove-client", "client", "remove", "-id", "1234"}, env)
+	assert.Nil(t, err, "%s", err)
+	_, err = storage.LoadAccess("1")
+	assert.Equal(t, osindynamodb.ErrAccessNotFound, err)
+	env, _ = testEnvironment(db, "", nil)
+	err = run([]string{"-prefix", "SchemaAndClient", "client", "get", "-id", "1234"}, env)
+	assert.Equal(t, osindynamodb.ErrClientNotFound, err)
+}
+
+func TestEncryptedTokens(t *testing.T) {
+	t.Parallel()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	keyring, err := parseKeyring("current:" + key + ",retired:" + key)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, "current", keyring.CurrentKeyID)
+	_, err = parseKeyring("current")
+	assert.Equal(t, errInvalidEncryptionKeys, err)
+
+	db := fakedynamodb.New()
+	config := osindynamodb.CreateStorageConfig("EncryptedTokens")
+	config.Encrypter = keyring
+	config.RefreshTokenRotation = true
+	storage := osindynamodb.New(db, config)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	err = storage.SaveAccess(&osin.AccessData{
+		Client:       &osin.DefaultClient{Id: "1234"},
+		AccessToken:  "1",
+		RefreshToken: "r1",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	})
+	assert.Nil(t, err, "%s", err)
+
+	env, _ := testEnvironment(db, "", map[string]string{"OSIN_DYNAMODB_TOKEN": "1"})
+	err = run([]string{"-prefix", "EncryptedTokens", "token", "inspect"}, env)
+	assert.Equal(t, osindynamodb.ErrEncrypterNotConfigured, err)
+
+	variables := map[string]string{"OSIN_DYNAMODB_ENCRYPTION_KEYS": "current:" + key, "OSIN_DYNAMODB_TOKEN": "1"}
+	env, out := testEnvironment(db, "", variables)
+	err = run([]string{"-prefix", "EncryptedTokens", "token", "inspect"}, env)
+	assert.Nil(t, err, "%s", err)
+	assert.Contains(t, out.String(), `"RefreshToken":"r1"`)
+
+	// revoked refresh token is kept for reuse detection
+	env, _ = testEnvironment(db, "r1\n", variables)
+	err = run([]string{"-prefix", "EncryptedTokens", "-refresh-token-rotation", "token", "revoke", "-type", "refresh", "-token-stdin"}, env)
+	assert.Nil(t, err, "%s", err)
+	resp, err := db.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"token": {S: aws.String("r1")},
+		},
+		TableName: aws.String(config.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.NotNil(t, resp.Item["rotated_at"])
+}
+
+func TestInspectReadOnly(t *testing.T) {
+	t.Parallel()
+	db := fakedynamodb.New()
+	config := osindynamodb.CreateStorageConfig("InspectReadOnly")
+	config.RefreshTokenRotation = true
+	config.RefreshTokenIdleLifetime = time.Hour
+	storage := osindynamodb.New(db, config)
+	err := storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	for _, token := range []string{"1", "2"} {
+		err = storage.SaveAccess(&osin.AccessData{
+			Client:       &osin.DefaultClient{Id: "1234"},
+			AccessToken:  token,
+			RefreshToken: "r" + token,
+			ExpiresIn:    3600,
+			CreatedAt:    time.Now(),
+		})
+		assert.Nil(t, err, "%s", err)
+	}
+	err = storage.RemoveRefresh("r1")
+	assert.Nil(t, err, "%s", err)
+
+	scan := func() []map[string]*dynamodb.AttributeValue {
+		resp, err := db.Scan(&dynamodb.ScanInput{
+			TableName: aws.String(config.RefreshTable),
+		})
+		assert.Nil(t, err, "%s", err)
+		return resp.Items
+	}
+	before := scan()
+	// rotated and idle refresh tokens are inspected without revoking the family or extending the lifetime
+	for _, token := range []string{"r1", "r2"} {
+		env, out := testEnvironment(db, token+"\n", nil)
+		err = run([]string{"-prefix", "InspectReadOnly", "-refresh-token-rotation", "-refresh-token-idle-lifetime", "1h", "token", "inspect", "-type", "refresh", "-token-stdin"}, env)
+		assert.Nil(t, err, "%s", err)
+		assert.Contains(t, out.String(), `"RefreshToken":"`+token+`"`)
+	}
+	assert.ElementsMatch(t, before, scan())
+}
+
+func TestSchemaTableOptions(t *testing.T) {
+	t.Parallel()
+	db := fakedynamodb.New()
+	env, _ := testEnvironment(db, "", nil)
+	err := run([]string{"-prefix", "SchemaTableOptions", "-billing-mode", dynamodb.BillingModePayPerRequest, "-sse", "-point-in-time-recovery", "schema", "create"}, env)
+	assert.Nil(t, err, "%s", err)
+
+	config := osindynamodb.CreateStorageConfig("SchemaTableOptions")
+	for _, table := range []string{config.ClientTable, config.AuthorizeTable, config.AccessTable, config.RefreshTable} {
+		resp, err := db.DescribeTable(&dynamodb.DescribeTableInput{
+			TableName: aws.String(table),
+		})
+		assert.Nil(t, err, "%s", err)
+		assert.Equal(t, dynamodb.BillingModePayPerRequest, aws.StringValue(resp.Table.BillingModeSummary.BillingMode))
+		assert.NotNil(t, resp.Table.SSEDescription)
+		backups, err := db.DescribeContinuousBackupsWithContext(context.Background(), &dynamodb.DescribeContinuousBackupsInput{
+			TableName: aws.String(table),
+		})
+		assert.Nil(t, err, "%s", err)
+		assert.Equal(t, dynamodb.PointInTimeRecoveryStatusEnabled, aws.StringValue(backups.ContinuousBackupsDescription.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus))
+	}
+
+	env, _ = testEnvironment(db, "", nil)
+	err = run([]string{"-prefix", "SchemaTableOptions", "-point-in-time-recovery", "schema", "verify"}, env)
+	assert.Nil(t, err, "%s", err)
+}
@@ -0,0 +1,181 @@
+package osindynamodb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var (
+	// ErrEncrypterNotConfigured is returned when encrypted item is read but StorageConfig.Encrypter is nil
+	ErrEncrypterNotConfigured = errors.New("Encrypter not configured")
+	// ErrUnknownKeyID is returned by AESGCMKeyring if ciphertext was encrypted with unknown key
+	ErrUnknownKeyID = errors.New("Unknown encryption key id")
+	// ErrInvalidCiphertext is returned by AESGCMKeyring if ciphertext is malformed
+	ErrInvalidCiphertext = errors.New("Invalid ciphertext")
+
+	errMissingPayload = errors.New("Item has no json attribute")
+)
+
+// Encrypter allows to encrypt json attribute before it's stored in DynamoDB.
+// Implementations should be able to decrypt everything they have ever encrypted,
+// e.g. by keeping retired keys, so items written before key rotation stay readable.
+type Encrypter interface {
+	// Encrypt encrypts plaintext and authenticates it together with additionalData,
+	// which identifies the item and attribute ciphertext is stored in
+	Encrypt(plaintext []byte, additionalData []byte) ([]byte, error)
+	// Decrypt decrypts ciphertext returned by Encrypt, it must fail if additionalData differs
+	Decrypt(ciphertext []byte, additionalData []byte) ([]byte, error)
+}
+
+// aesGCMVersion is the first byte of AESGCMKeyring ciphertexts, it allows to change format later
+const aesGCMVersion = 0
+
+// AESGCMKeyring implements Encrypter with AES-GCM.
+// Every ciphertext is prefixed with id of the key it was encrypted with,
+// so keys can be rotated by changing CurrentKeyID and keeping old keys in Keys.
+type AESGCMKeyring struct {
+	// CurrentKeyID is id of key used for encryption
+	CurrentKeyID string
+	// Keys maps key id to AES key (16, 24 or 32 bytes)
+	Keys map[string][]byte
+}
+
+// NewAESGCMKeyring returns AESGCMKeyring encrypting with currentKeyID
+func NewAESGCMKeyring(currentKeyID string, keys map[string][]byte) (*AESGCMKeyring, error) {
+	if len(currentKeyID) == 0 || len(currentKeyID) > 255 {
+		return nil, errors.New("Key id must be 1 to 255 bytes long")
+	}
+	if _, ok := keys[currentKeyID]; !ok {
+		return nil, ErrUnknownKeyID
+	}
+	for _, key := range keys {
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return &AESGCMKeyring{
+		CurrentKeyID: currentKeyID,
+		Keys:         keys,
+	}, nil
+}
+
+// Encrypt encrypts plaintext with current key.
+// Format: version (1 byte) | key id length (1 byte) | key id | nonce | sealed data.
+// Header and additionalData are authenticated.
+func (receiver *AESGCMKeyring) Encrypt(plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := receiver.aead(receiver.CurrentKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, 2+len(receiver.CurrentKeyID))
+	header = append(header, aesGCMVersion, byte(len(receiver.CurrentKeyID)))
+	header = append(header, receiver.CurrentKeyID...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, authenticatedData(header, additionalData)), nil
+}
+
+// Decrypt decrypts ciphertext with the key it was encrypted with
+func (receiver *AESGCMKeyring) Decrypt(ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < 2 || ciphertext[0] != aesGCMVersion || len(ciphertext) < 2+int(ciphertext[1]) {
+		return nil, ErrInvalidCiphertext
+	}
+	headerLength := 2 + int(ciphertext[1])
+	header := ciphertext[:headerLength]
+	aead, err := receiver.aead(string(header[2:]))
+	if err != nil {
+		return nil, err
+	}
+
+	rest := ciphertext[headerLength:]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], authenticatedData(header, additionalData))
+}
+
+// authenticatedData returns header followed by additionalData in a new slice
+func authenticatedData(header []byte, additionalData []byte) []byte {
+	data := make([]byte, 0, len(header)+len(additionalData))
+	data = append(data, header...)
+	return append(data, additionalData...)
+}
+
+func (receiver *AESGCMKeyring) aead(keyID string) (cipher.AEAD, error) {
+	key, ok := receiver.Keys[keyID]
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// payloadContext returns additional data binding encrypted attribute to the item of e with key,
+// so ciphertext copied to another item or attribute can't be decrypted. Table is identified by entity,
+// not by its name, so items stay readable when exported and imported to tables with other names.
+func payloadContext(e entity, key string, attribute string) []byte {
+	var context []byte
+	for _, part := range []string{e.prefix, key, attribute} {
+		context = strconv.AppendInt(context, int64(len(part)), 10)
+		context = append(context, ':')
+		context = append(context, part...)
+	}
+	return context
+}
+
+// itemPayloadContext returns payloadContext of attribute of item of e
+func itemPayloadContext(e entity, item map[string]*dynamodb.AttributeValue, attribute string) []byte {
+	return payloadContext(e, aws.StringValue(item[e.keyName].S), attribute)
+}
+
+// encodePayload returns value of json attribute.
+// Payload is stored as binary attribute if Encrypter is configured and as string otherwise.
+func (receiver *Storage) encodePayload(data []byte, context []byte) (*dynamodb.AttributeValue, error) {
+	if receiver.config.Encrypter == nil {
+		return &dynamodb.AttributeValue{
+			S: aws.String(string(data)),
+		}, nil
+	}
+
+	ciphertext, err := receiver.config.Encrypter.Encrypt(data, context)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.AttributeValue{
+		B: ciphertext,
+	}, nil
+}
+
+// decodePayload reads value of json attribute written by encodePayload with the same context.
+// Plaintext items written before Encrypter was configured are still readable.
+func (receiver *Storage) decodePayload(value *dynamodb.AttributeValue, context []byte) ([]byte, error) {
+	if value == nil {
+		return nil, errMissingPayload
+	}
+	if value.B == nil {
+		return []byte(aws.StringValue(value.S)), nil
+	}
+	if receiver.config.Encrypter == nil {
+		return nil, ErrEncrypterNotConfigured
+	}
+	return receiver.config.Encrypter.Decrypt(value.B, context)
+}
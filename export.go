@@ -0,0 +1,373 @@
+package osindynamodb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ErrInvalidRecord is returned by Import if a line isn't a valid Record
+var ErrInvalidRecord = errors.New("Invalid record")
+
+// RecordType tells which entity is stored in Record
+type RecordType string
+
+const (
+	// RecordClient is a client
+	RecordClient RecordType = "client"
+	// RecordAuthorize is an authorization code
+	RecordAuthorize RecordType = "authorize"
+	// RecordAccess is an access token
+	RecordAccess RecordType = "access"
+	// RecordRefresh is a refresh token
+	RecordRefresh RecordType = "refresh"
+)
+
+// recordEntities maps record types to entities in export order
+var recordEntities = []struct {
+	recordType RecordType
+	entity     entity
+}{
+	{RecordClient, clientEntity},
+	{RecordAuthorize, authorizeEntity},
+	{RecordAccess, accessEntity},
+	{RecordRefresh, refreshEntity},
+}
+
+// defaultExportSegments is the number of parallel scan segments used if ExportOptions.Segments is zero
+const defaultExportSegments = 4
+
+// Record is a single line written by Export and read by Import
+type Record struct {
+	// Type of the entity
+	Type RecordType `json:"type"`
+	// Item is the DynamoDB item as it's stored, so hashed tokens, encrypted payloads
+	// and user data attributes are preserved. Keys of SingleTable (pk and sk) are left out,
+	// so records can be imported to either table layout.
+	Item map[string]*dynamodb.AttributeValue `json:"item"`
+}
+
+// recordJSON is Record as it's written, with attributes in compact DynamoDB JSON
+type recordJSON struct {
+	Type RecordType                `json:"type"`
+	Item map[string]*attributeJSON `json:"item"`
+}
+
+// attributeJSON is dynamodb.AttributeValue without the unset types, so records don't carry
+// a null for each of them. Lists and maps are pointers, so empty ones are kept.
+type attributeJSON struct {
+	B    []byte                     `json:"B,omitempty"`
+	BOOL *bool                      `json:"BOOL,omitempty"`
+	BS   [][]byte                   `json:"BS,omitempty"`
+	L    *[]*attributeJSON          `json:"L,omitempty"`
+	M    *map[string]*attributeJSON `json:"M,omitempty"`
+	N    *string                    `json:"N,omitempty"`
+	NS   []*string                  `json:"NS,omitempty"`
+	NULL *bool                      `json:"NULL,omitempty"`
+	S    *string                    `json:"S,omitempty"`
+	SS   []*string                  `json:"SS,omitempty"`
+}
+
+// MarshalJSON writes Record with only the set type of each attribute
+func (receiver Record) MarshalJSON() ([]byte, error) {
+	return json.Marshal(recordJSON{
+		Type: receiver.Type,
+		Item: attributesToJSON(receiver.Item),
+	})
+}
+
+// UnmarshalJSON reads Record in the compact form written by MarshalJSON
+func (receiver *Record) UnmarshalJSON(data []byte) error {
+	var record recordJSON
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	receiver.Type = record.Type
+	receiver.Item = attributesFromJSON(record.Item)
+	return nil
+}
+
+// attributesToJSON converts item to compact attributes
+func attributesToJSON(item map[string]*dynamodb.AttributeValue) map[string]*attributeJSON {
+	if item == nil {
+		return nil
+	}
+	attributes := make(map[string]*attributeJSON, len(item))
+	for name, value := range item {
+		attributes[name] = attributeToJSON(value)
+	}
+	return attributes
+}
+
+// attributeToJSON converts value to compact attribute
+func attributeToJSON(value *dynamodb.AttributeValue) *attributeJSON {
+	if value == nil {
+		return nil
+	}
+	attribute := &attributeJSON{
+		B:    value.B,
+		BOOL: value.BOOL,
+		BS:   value.BS,
+		N:    value.N,
+		NS:   value.NS,
+		NULL: value.NULL,
+		S:    value.S,
+		SS:   value.SS,
+	}
+	if value.L != nil {
+		list := make([]*attributeJSON, 0, len(value.L))
+		for _, element := range value.L {
+			list = append(list, attributeToJSON(element))
+		}
+		attribute.L = &list
+	}
+	if value.M != nil {
+		m := attributesToJSON(value.M)
+		attribute.M = &m
+	}
+	return attribute
+}
+
+// attributesFromJSON converts compact attributes to item
+func attributesFromJSON(attributes map[string]*attributeJSON) map[string]*dynamodb.AttributeValue {
+	if attributes == nil {
+		return nil
+	}
+	item := make(map[string]*dynamodb.AttributeValue, len(attributes))
+	for name, attribute := range attributes {
+		item[name] = attributeFromJSON(attribute)
+	}
+	return item
+}
+
+// attributeFromJSON converts compact attribute to value
+func attributeFromJSON(attribute *attributeJSON) *dynamodb.AttributeValue {
+	if attribute == nil {
+		return nil
+	}
+	value := &dynamodb.AttributeValue{
+		B:    attribute.B,
+		BOOL: attribute.BOOL,
+		BS:   attribute.BS,
+		N:    attribute.N,
+		NS:   attribute.NS,
+		NULL: attribute.NULL,
+		S:    attribute.S,
+		SS:   attribute.SS,
+	}
+	if attribute.L != nil {
+		value.L = make([]*dynamodb.AttributeValue, 0, len(*attribute.L))
+		for _, element := range *attribute.L {
+			value.L = append(value.L, attributeFromJSON(element))
+		}
+	}
+	if attribute.M != nil {
+		value.M = attributesFromJSON(*attribute.M)
+	}
+	return value
+}
+
+// ExportOptions allows to select what is exported
+type ExportOptions struct {
+	// SkipExpired leaves out authorization codes, access and refresh tokens expired according to
+	// their Time To Live attribute. Items without the attribute are always exported.
+	SkipExpired bool
+	// ClientsOnly exports only clients
+	ClientsOnly bool
+	// Segments is the number of parallel scan segments per table. If zero 4 is used.
+	Segments int64
+}
+
+// Export writes all clients, authorization codes, access and refresh tokens to w as JSON Lines of Record.
+// Tables are read with parallel scans, so records of the same type are not ordered.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) Export(w io.Writer, options ExportOptions) error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.ExportWithContext(ctx, w, options)
+}
+
+// ExportWithContext is the same as Export with the ability to pass a context.
+func (receiver *Storage) ExportWithContext(ctx context.Context, w io.Writer, options ExportOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	segments := options.Segments
+	if segments <= 0 {
+		segments = defaultExportSegments
+	}
+	now := time.Now().Unix()
+
+	var mutex sync.Mutex
+	encoder := json.NewEncoder(w)
+	write := func(record Record) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return encoder.Encode(record)
+	}
+
+	for _, recordEntity := range recordEntities {
+		if options.ClientsOnly && recordEntity.entity != clientEntity {
+			continue
+		}
+		recordType, e := recordEntity.recordType, recordEntity.entity
+		skipExpired := options.SkipExpired && e != clientEntity
+
+		var wg sync.WaitGroup
+		errs := make([]error, segments)
+		for segment := int64(0); segment < segments; segment++ {
+			wg.Add(1)
+			go func(segment int64) {
+				defer wg.Done()
+				params := receiver.exportScan(e, segment, segments)
+				var writeErr error
+				err := receiver.db.ScanPagesWithContext(ctx, params, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+					for _, item := range page.Items {
+						if skipExpired && receiver.expiredBefore(item, now) {
+							continue
+						}
+						delete(item, "pk")
+						delete(item, "sk")
+						if writeErr = write(Record{Type: recordType, Item: item}); writeErr != nil {
+							return false
+						}
+					}
+					return true
+				})
+				if err == nil {
+					err = writeErr
+				}
+				if err != nil {
+					errs[segment] = err
+					cancel()
+				}
+			}(segment)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// exportScan returns scan of one segment of items of e
+func (receiver *Storage) exportScan(e entity, segment int64, segments int64) *dynamodb.ScanInput {
+	params := &dynamodb.ScanInput{
+		TableName:     receiver.tableName(e),
+		Segment:       aws.Int64(segment),
+		TotalSegments: aws.Int64(segments),
+	}
+	if receiver.usesSingleTable() {
+		params.FilterExpression = aws.String("#sk = :sk")
+		params.ExpressionAttributeNames = map[string]*string{
+			"#sk": aws.String("sk"),
+		}
+		params.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":sk": {
+				S: aws.String(e.prefix),
+			},
+		}
+	}
+	return params
+}
+
+// expiredBefore reports whether Time To Live attribute of item is before now (unix epoch)
+func (receiver *Storage) expiredBefore(item map[string]*dynamodb.AttributeValue, now int64) bool {
+	value, ok := item[receiver.ttlAttribute()]
+	if !ok || value.N == nil {
+		return false
+	}
+	expireAt, err := strconv.ParseInt(*value.N, 10, 64)
+	return err == nil && expireAt < now
+}
+
+// Import writes records read from r as JSON Lines of Record, e.g. written by Export.
+// Existing items with the same keys are overwritten and if a key is repeated, the last record wins.
+// Items are written with BatchWriteItem, unprocessed items are retried.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) Import(r io.Reader) error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.ImportWithContext(ctx, r)
+}
+
+// ImportWithContext is the same as Import with the ability to pass a context.
+func (receiver *Storage) ImportWithContext(ctx context.Context, r io.Reader) error {
+	entities := map[RecordType]entity{}
+	for _, recordEntity := range recordEntities {
+		entities[recordEntity.recordType] = recordEntity.entity
+	}
+
+	pending := map[string][]*dynamodb.WriteRequest{}
+	// pendingKeys maps keys of pending items to their index, as a batch can't write the same item twice
+	pendingKeys := map[string]map[string]int{}
+	flush := func(tableName string) error {
+		requests := pending[tableName]
+		delete(pending, tableName)
+		delete(pendingKeys, tableName)
+		return receiver.batchWrite(ctx, tableName, requests)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return ErrInvalidRecord
+		}
+		e, ok := entities[record.Type]
+		if !ok || record.Item[e.keyName] == nil || record.Item[e.keyName].S == nil {
+			return ErrInvalidRecord
+		}
+		receiver.setItemKey(record.Item, e)
+
+		tableName := *receiver.tableName(e)
+		request := &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{
+				Item: record.Item,
+			},
+		}
+		if pendingKeys[tableName] == nil {
+			pendingKeys[tableName] = map[string]int{}
+		}
+		key := e.prefix + "#" + *record.Item[e.keyName].S
+		if i, ok := pendingKeys[tableName][key]; ok {
+			pending[tableName][i] = request
+			continue
+		}
+		pendingKeys[tableName][key] = len(pending[tableName])
+		pending[tableName] = append(pending[tableName], request)
+		if len(pending[tableName]) >= batchWriteLimit {
+			if err := flush(tableName); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for tableName := range pending {
+		if err := flush(tableName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,745 @@
+package fakedynamodb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// item is a DynamoDB item
+type item = map[string]*dynamodb.AttributeValue
+
+// condition reports whether item satisfies condition expression
+type condition func(it item) bool
+
+// errInvalidDocumentPath is returned if parent of updated nested attribute doesn't exist
+var errInvalidDocumentPath = errors.New("The document path provided in the update expression is invalid for update")
+
+// documentPath is the name of top level attribute followed by names of nested map elements
+type documentPath []string
+
+// lookup returns value at path in item and whether it's present
+func (receiver documentPath) lookup(it item) (*dynamodb.AttributeValue, bool) {
+	value := it[receiver[0]]
+	for _, name := range receiver[1:] {
+		if value == nil || value.M == nil {
+			return nil, false
+		}
+		value = value.M[name]
+	}
+	return value, value != nil
+}
+
+// parent returns map holding the last element of path, nil if it doesn't exist
+func (receiver documentPath) parent(it item) map[string]*dynamodb.AttributeValue {
+	parent := map[string]*dynamodb.AttributeValue(it)
+	for _, name := range receiver[:len(receiver)-1] {
+		value := parent[name]
+		if value == nil || value.M == nil {
+			return nil
+		}
+		parent = value.M
+	}
+	return parent
+}
+
+// set replaces value at path in item
+func (receiver documentPath) set(it item, value *dynamodb.AttributeValue) error {
+	parent := receiver.parent(it)
+	if parent == nil {
+		return errInvalidDocumentPath
+	}
+	parent[receiver[len(receiver)-1]] = value
+	return nil
+}
+
+// operand is an attribute path or a value of expression
+type operand struct {
+	// path is the path of attribute, nil for values
+	path documentPath
+	// value is the value of expression attribute value, nil for attributes
+	value *dynamodb.AttributeValue
+}
+
+// resolve returns value of operand in item and whether it's present
+func (receiver operand) resolve(it item) (*dynamodb.AttributeValue, bool) {
+	if receiver.value != nil {
+		return receiver.value, true
+	}
+	return receiver.path.lookup(it)
+}
+
+// placeholders are expression attribute names and values of one request.
+// Every one of them must be used by some expression of the request.
+type placeholders struct {
+	names      map[string]*string
+	values     map[string]*dynamodb.AttributeValue
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func newPlaceholders(names map[string]*string, values map[string]*dynamodb.AttributeValue) *placeholders {
+	return &placeholders{
+		names:      names,
+		values:     values,
+		usedNames:  map[string]bool{},
+		usedValues: map[string]bool{},
+	}
+}
+
+// name returns attribute name of name placeholder
+func (receiver *placeholders) name(token string) (string, error) {
+	name, ok := receiver.names[token]
+	if !ok || name == nil {
+		return "", fmt.Errorf("expression attribute name %s is not defined", token)
+	}
+	receiver.usedNames[token] = true
+	return *name, nil
+}
+
+// value returns attribute value of value placeholder
+func (receiver *placeholders) value(token string) (*dynamodb.AttributeValue, error) {
+	value, ok := receiver.values[token]
+	if !ok || value == nil {
+		return nil, fmt.Errorf("expression attribute value %s is not defined", token)
+	}
+	receiver.usedValues[token] = true
+	return value, nil
+}
+
+// unused returns ValidationException if some names or values are not used by expressions
+func (receiver *placeholders) unused() error {
+	var names, values []string
+	for token := range receiver.names {
+		if !receiver.usedNames[token] {
+			names = append(names, token)
+		}
+	}
+	for token := range receiver.values {
+		if !receiver.usedValues[token] {
+			values = append(values, token)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(values)
+	if len(names) > 0 {
+		return validationError(fmt.Sprintf("Value provided in ExpressionAttributeNames unused in expressions: keys: {%s}", strings.Join(names, ", ")))
+	}
+	if len(values) > 0 {
+		return validationError(fmt.Sprintf("Value provided in ExpressionAttributeValues unused in expressions: keys: {%s}", strings.Join(values, ", ")))
+	}
+	return nil
+}
+
+// expression parses one DynamoDB expression
+type expression struct {
+	tokens       []string
+	pos          int
+	placeholders *placeholders
+}
+
+func newExpression(text string, p *placeholders) (*expression, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	return &expression{
+		tokens:       tokens,
+		placeholders: p,
+	}, nil
+}
+
+// tokenize splits expression into names, placeholders, keywords, operators and parentheses
+func tokenize(text string) ([]string, error) {
+	var tokens []string
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.ContainsRune("(),.=+-", r):
+			tokens = append(tokens, string(r))
+			i++
+		case r == '<' || r == '>':
+			if i+1 < len(runes) && (runes[i+1] == '=' || (r == '<' && runes[i+1] == '>')) {
+				tokens = append(tokens, string(runes[i:i+2]))
+				i += 2
+			} else {
+				tokens = append(tokens, string(r))
+				i++
+			}
+		case r == '#' || r == ':' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			start := i
+			i++
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		default:
+			return nil, fmt.Errorf("unsupported character %q", r)
+		}
+	}
+	return tokens, nil
+}
+
+func (receiver *expression) peek() string {
+	if receiver.pos < len(receiver.tokens) {
+		return receiver.tokens[receiver.pos]
+	}
+	return ""
+}
+
+func (receiver *expression) next() string {
+	token := receiver.peek()
+	receiver.pos++
+	return token
+}
+
+func (receiver *expression) keyword(keyword string) bool {
+	if strings.EqualFold(receiver.peek(), keyword) {
+		receiver.pos++
+		return true
+	}
+	return false
+}
+
+func (receiver *expression) expect(token string) error {
+	if got := receiver.next(); got != token {
+		return fmt.Errorf("expected %q, got %q", token, got)
+	}
+	return nil
+}
+
+func (receiver *expression) done() error {
+	if receiver.pos < len(receiver.tokens) {
+		return fmt.Errorf("unexpected %q", receiver.peek())
+	}
+	return nil
+}
+
+// path parses document path of names separated by dots
+func (receiver *expression) path() (documentPath, error) {
+	var path documentPath
+	for {
+		name, err := receiver.name()
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, name)
+		if receiver.peek() != "." {
+			return path, nil
+		}
+		receiver.pos++
+	}
+}
+
+// name parses attribute name or name placeholder, reserved words must be passed as placeholders
+func (receiver *expression) name() (string, error) {
+	token := receiver.next()
+	if strings.HasPrefix(token, "#") {
+		return receiver.placeholders.name(token)
+	}
+	if token == "" || strings.HasPrefix(token, ":") || !isName(token) {
+		return "", fmt.Errorf("expected attribute name, got %q", token)
+	}
+	if reservedWords[strings.ToUpper(token)] {
+		return "", fmt.Errorf("attribute name is a reserved keyword; reserved keyword: %s", token)
+	}
+	return token, nil
+}
+
+// operand parses path or value placeholder
+func (receiver *expression) operand() (operand, error) {
+	token := receiver.peek()
+	if strings.HasPrefix(token, ":") {
+		receiver.pos++
+		value, err := receiver.placeholders.value(token)
+		if err != nil {
+			return operand{}, err
+		}
+		return operand{value: value}, nil
+	}
+	path, err := receiver.path()
+	if err != nil {
+		return operand{}, err
+	}
+	return operand{path: path}, nil
+}
+
+func isName(token string) bool {
+	for _, r := range token {
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCondition parses condition, filter or key condition expression
+func parseCondition(text string, p *placeholders) (condition, error) {
+	e, err := newExpression(text, p)
+	if err != nil {
+		return nil, err
+	}
+	c, err := e.or()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.done(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (receiver *expression) or() (condition, error) {
+	left, err := receiver.and()
+	if err != nil {
+		return nil, err
+	}
+	for receiver.keyword("OR") {
+		right, err := receiver.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(it item) bool {
+			return l(it) || right(it)
+		}
+	}
+	return left, nil
+}
+
+func (receiver *expression) and() (condition, error) {
+	left, err := receiver.not()
+	if err != nil {
+		return nil, err
+	}
+	for receiver.keyword("AND") {
+		right, err := receiver.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(it item) bool {
+			return l(it) && right(it)
+		}
+	}
+	return left, nil
+}
+
+func (receiver *expression) not() (condition, error) {
+	if receiver.keyword("NOT") {
+		c, err := receiver.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) bool {
+			return !c(it)
+		}, nil
+	}
+	return receiver.primary()
+}
+
+func (receiver *expression) primary() (condition, error) {
+	if receiver.peek() == "(" {
+		receiver.pos++
+		c, err := receiver.or()
+		if err != nil {
+			return nil, err
+		}
+		return c, receiver.expect(")")
+	}
+
+	switch function := strings.ToLower(receiver.peek()); function {
+	case "attribute_exists", "attribute_not_exists":
+		receiver.pos++
+		if err := receiver.expect("("); err != nil {
+			return nil, err
+		}
+		path, err := receiver.path()
+		if err != nil {
+			return nil, err
+		}
+		if err := receiver.expect(")"); err != nil {
+			return nil, err
+		}
+		exists := function == "attribute_exists"
+		return func(it item) bool {
+			_, ok := path.lookup(it)
+			return ok == exists
+		}, nil
+	case "begins_with", "contains":
+		receiver.pos++
+		if err := receiver.expect("("); err != nil {
+			return nil, err
+		}
+		left, err := receiver.operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := receiver.expect(","); err != nil {
+			return nil, err
+		}
+		right, err := receiver.operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := receiver.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(it item) bool {
+			l, lok := left.resolve(it)
+			r, rok := right.resolve(it)
+			if !lok || !rok {
+				return false
+			}
+			if function == "begins_with" {
+				return beginsWith(l, r)
+			}
+			return contains(l, r)
+		}, nil
+	}
+
+	left, err := receiver.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	if receiver.keyword("BETWEEN") {
+		low, err := receiver.operand()
+		if err != nil {
+			return nil, err
+		}
+		if !receiver.keyword("AND") {
+			return nil, fmt.Errorf("expected AND in BETWEEN")
+		}
+		high, err := receiver.operand()
+		if err != nil {
+			return nil, err
+		}
+		return func(it item) bool {
+			return compareOperands(it, low, left, "<=") && compareOperands(it, left, high, "<=")
+		}, nil
+	}
+
+	if receiver.keyword("IN") {
+		if err := receiver.expect("("); err != nil {
+			return nil, err
+		}
+		var candidates []operand
+		for {
+			candidate, err := receiver.operand()
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, candidate)
+			if receiver.peek() != "," {
+				break
+			}
+			receiver.pos++
+		}
+		if err := receiver.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(it item) bool {
+			for _, candidate := range candidates {
+				if compareOperands(it, left, candidate, "=") {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	comparator := receiver.next()
+	switch comparator {
+	case "=", "<>", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("expected comparator, got %q", comparator)
+	}
+	right, err := receiver.operand()
+	if err != nil {
+		return nil, err
+	}
+	return func(it item) bool {
+		return compareOperands(it, left, right, comparator)
+	}, nil
+}
+
+// compareOperands compares values of operands in item, missing attributes never match
+func compareOperands(it item, left operand, right operand, comparator string) bool {
+	l, lok := left.resolve(it)
+	r, rok := right.resolve(it)
+	if !lok || !rok {
+		return false
+	}
+	if comparator == "=" {
+		return equalValues(l, r)
+	}
+	if comparator == "<>" {
+		return !equalValues(l, r)
+	}
+
+	c, ok := compareValues(l, r)
+	if !ok {
+		return false
+	}
+	switch comparator {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+// equalValues reports whether attribute values are equal
+func equalValues(l *dynamodb.AttributeValue, r *dynamodb.AttributeValue) bool {
+	if c, ok := compareValues(l, r); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(l, r)
+}
+
+// compareValues compares scalar values of the same type
+func compareValues(l *dynamodb.AttributeValue, r *dynamodb.AttributeValue) (int, bool) {
+	switch {
+	case l.S != nil && r.S != nil:
+		return strings.Compare(*l.S, *r.S), true
+	case l.N != nil && r.N != nil:
+		ln, lok := new(big.Float).SetString(*l.N)
+		rn, rok := new(big.Float).SetString(*r.N)
+		if !lok || !rok {
+			return 0, false
+		}
+		return ln.Cmp(rn), true
+	case l.B != nil && r.B != nil:
+		return bytes.Compare(l.B, r.B), true
+	}
+	return 0, false
+}
+
+func beginsWith(value *dynamodb.AttributeValue, prefix *dynamodb.AttributeValue) bool {
+	switch {
+	case value.S != nil && prefix.S != nil:
+		return strings.HasPrefix(*value.S, *prefix.S)
+	case value.B != nil && prefix.B != nil:
+		return bytes.HasPrefix(value.B, prefix.B)
+	}
+	return false
+}
+
+func contains(value *dynamodb.AttributeValue, element *dynamodb.AttributeValue) bool {
+	switch {
+	case value.S != nil && element.S != nil:
+		return strings.Contains(*value.S, *element.S)
+	case value.SS != nil && element.S != nil:
+		for _, s := range value.SS {
+			if aws.StringValue(s) == *element.S {
+				return true
+			}
+		}
+	case value.L != nil:
+		for _, v := range value.L {
+			if equalValues(v, element) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// update writes changes of update expression to target, values are read from source,
+// so every action sees the item as it was before update
+type update func(source item, target item) error
+
+// parseUpdate parses update expression with SET and REMOVE clauses
+func parseUpdate(text string, p *placeholders) (update, error) {
+	e, err := newExpression(text, p)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []update
+	for e.peek() != "" {
+		switch clause := strings.ToUpper(e.next()); clause {
+		case "SET":
+			for {
+				u, err := e.set()
+				if err != nil {
+					return nil, err
+				}
+				updates = append(updates, u)
+				if e.peek() != "," {
+					break
+				}
+				e.pos++
+			}
+		case "REMOVE":
+			for {
+				path, err := e.path()
+				if err != nil {
+					return nil, err
+				}
+				updates = append(updates, func(source item, target item) error {
+					parent := path.parent(target)
+					if parent == nil {
+						return errInvalidDocumentPath
+					}
+					delete(parent, path[len(path)-1])
+					return nil
+				})
+				if e.peek() != "," {
+					break
+				}
+				e.pos++
+			}
+		default:
+			return nil, fmt.Errorf("unsupported update clause %q", clause)
+		}
+	}
+	if len(updates) == 0 {
+		return nil, fmt.Errorf("empty update expression")
+	}
+
+	return func(source item, target item) error {
+		for _, u := range updates {
+			if err := u(source, target); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// set parses "path = value" of SET clause, value can be operand, if_not_exists(path, operand) or sum or difference
+func (receiver *expression) set() (update, error) {
+	path, err := receiver.path()
+	if err != nil {
+		return nil, err
+	}
+	if err := receiver.expect("="); err != nil {
+		return nil, err
+	}
+	value, err := receiver.setValue()
+	if err != nil {
+		return nil, err
+	}
+	operator := receiver.peek()
+	if operator != "+" && operator != "-" {
+		return func(source item, target item) error {
+			v, err := value(source)
+			if err != nil {
+				return err
+			}
+			return path.set(target, v)
+		}, nil
+	}
+	receiver.pos++
+	other, err := receiver.setValue()
+	if err != nil {
+		return nil, err
+	}
+	return func(source item, target item) error {
+		l, err := value(source)
+		if err != nil {
+			return err
+		}
+		r, err := other(source)
+		if err != nil {
+			return err
+		}
+		if l.N == nil || r.N == nil {
+			return fmt.Errorf("an operand in the update expression has an incorrect data type")
+		}
+		ln, _ := new(big.Float).SetPrec(200).SetString(*l.N)
+		rn, _ := new(big.Float).SetPrec(200).SetString(*r.N)
+		if ln == nil || rn == nil {
+			return fmt.Errorf("invalid number")
+		}
+		if operator == "+" {
+			ln.Add(ln, rn)
+		} else {
+			ln.Sub(ln, rn)
+		}
+		return path.set(target, &dynamodb.AttributeValue{N: aws.String(ln.Text('f', -1))})
+	}, nil
+}
+
+func (receiver *expression) setValue() (func(it item) (*dynamodb.AttributeValue, error), error) {
+	if strings.EqualFold(receiver.peek(), "if_not_exists") {
+		receiver.pos++
+		if err := receiver.expect("("); err != nil {
+			return nil, err
+		}
+		path, err := receiver.path()
+		if err != nil {
+			return nil, err
+		}
+		if err := receiver.expect(","); err != nil {
+			return nil, err
+		}
+		fallback, err := receiver.operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := receiver.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(it item) (*dynamodb.AttributeValue, error) {
+			if v, ok := path.lookup(it); ok {
+				return v, nil
+			}
+			v, _ := fallback.resolve(it)
+			return v, nil
+		}, nil
+	}
+
+	o, err := receiver.operand()
+	if err != nil {
+		return nil, err
+	}
+	return func(it item) (*dynamodb.AttributeValue, error) {
+		v, ok := o.resolve(it)
+		if !ok {
+			return nil, fmt.Errorf("the provided expression refers to an attribute that does not exist in the item")
+		}
+		return v, nil
+	}, nil
+}
+
+// parseProjection parses projection expression to list of top level attribute names
+func parseProjection(text string, p *placeholders) ([]string, error) {
+	e, err := newExpression(text, p)
+	if err != nil {
+		return nil, err
+	}
+	var projection []string
+	for {
+		path, err := e.path()
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > 1 {
+			return nil, fmt.Errorf("projection of nested attributes is not supported")
+		}
+		projection = append(projection, path[0])
+		if e.peek() != "," {
+			break
+		}
+		e.pos++
+	}
+	return projection, e.done()
+}
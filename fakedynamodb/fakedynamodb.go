@@ -0,0 +1,1397 @@
+// Package fakedynamodb is an in-memory implementation of the subset of DynamoDB API used by osin-dynamodb.
+//
+// It allows to run osin flows with osindynamodb.Storage in go test without DynamoDB Local:
+//
+//	storage := osindynamodb.New(fakedynamodb.New(), osindynamodb.CreateStorageConfig("test"))
+//	storage.CreateSchema()
+//
+// Tables, global secondary indexes, Time To Live and point in time recovery settings are kept in memory,
+// tables and indexes are active as soon as they are created. Condition, filter, key condition and update
+// expressions are supported for top level attributes and elements of nested maps, projection expressions
+// for top level attributes only. Requests DynamoDB rejects are rejected as well,
+// e.g. reserved words used as attribute names in expressions, unused expression attribute names or values,
+// duplicate keys in a batch and throughput not matching billing mode of table. Items expired according to Time To Live are not removed.
+// Methods of DynamoDB API which are not implemented panic.
+package fakedynamodb
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// errCodeValidation is the error code of invalid requests
+const errCodeValidation = "ValidationException"
+
+// DB is an in-memory DynamoDB, safe for concurrent use
+type DB struct {
+	// DynamoDBAPI is nil, so methods which are not implemented panic
+	dynamodbiface.DynamoDBAPI
+
+	mutex  sync.Mutex
+	tables map[string]*table
+}
+
+// table is a table with its items
+type table struct {
+	description         *dynamodb.TableDescription
+	timeToLive          *dynamodb.TimeToLiveDescription
+	pointInTimeRecovery bool
+	// items by keyString of table keys
+	items map[string]item
+}
+
+// New returns empty DB
+func New() *DB {
+	return &DB{
+		tables: map[string]*table{},
+	}
+}
+
+// CreateTable creates table, see CreateTableWithContext
+func (receiver *DB) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	return receiver.CreateTableWithContext(aws.BackgroundContext(), input)
+}
+
+// CreateTableWithContext creates table which is active immediately
+func (receiver *DB) CreateTableWithContext(ctx aws.Context, input *dynamodb.CreateTableInput, _ ...request.Option) (*dynamodb.CreateTableOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	tableName := *input.TableName
+	if _, ok := receiver.tables[tableName]; ok {
+		return nil, &dynamodb.ResourceInUseException{
+			Message_: aws.String(fmt.Sprintf("Table already exists: %s", tableName)),
+		}
+	}
+
+	description := &dynamodb.TableDescription{
+		TableName:             aws.String(tableName),
+		TableArn:              aws.String("arn:aws:dynamodb:local:000000000000:table/" + tableName),
+		TableStatus:           aws.String(dynamodb.TableStatusActive),
+		CreationDateTime:      aws.Time(time.Now()),
+		KeySchema:             input.KeySchema,
+		AttributeDefinitions:  input.AttributeDefinitions,
+		ProvisionedThroughput: throughputDescription(input.ProvisionedThroughput),
+		BillingModeSummary: &dynamodb.BillingModeSummary{
+			BillingMode: aws.String(billingMode(input.BillingMode)),
+		},
+		StreamSpecification: input.StreamSpecification,
+	}
+	if err := checkKeys(input.KeySchema, input.AttributeDefinitions); err != nil {
+		return nil, err
+	}
+	mode := billingMode(input.BillingMode)
+	if err := checkThroughput(mode, input.ProvisionedThroughput); err != nil {
+		return nil, err
+	}
+	for _, index := range input.GlobalSecondaryIndexes {
+		if err := checkKeys(index.KeySchema, input.AttributeDefinitions); err != nil {
+			return nil, err
+		}
+		if err := checkThroughput(mode, index.ProvisionedThroughput); err != nil {
+			return nil, err
+		}
+		description.GlobalSecondaryIndexes = append(description.GlobalSecondaryIndexes, indexDescription(index))
+	}
+	if input.SSESpecification != nil && aws.BoolValue(input.SSESpecification.Enabled) {
+		description.SSEDescription = &dynamodb.SSEDescription{
+			Status:          aws.String(dynamodb.SSEStatusEnabled),
+			SSEType:         input.SSESpecification.SSEType,
+			KMSMasterKeyArn: input.SSESpecification.KMSMasterKeyId,
+		}
+	}
+
+	receiver.tables[tableName] = &table{
+		description: copyValue(description).(*dynamodb.TableDescription),
+		items:       map[string]item{},
+	}
+
+	return &dynamodb.CreateTableOutput{
+		TableDescription: description,
+	}, nil
+}
+
+// DeleteTable deletes table, see DeleteTableWithContext
+func (receiver *DB) DeleteTable(input *dynamodb.DeleteTableInput) (*dynamodb.DeleteTableOutput, error) {
+	return receiver.DeleteTableWithContext(aws.BackgroundContext(), input)
+}
+
+// DeleteTableWithContext deletes table with all its items
+func (receiver *DB) DeleteTableWithContext(ctx aws.Context, input *dynamodb.DeleteTableInput, _ ...request.Option) (*dynamodb.DeleteTableOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	delete(receiver.tables, *input.TableName)
+
+	description := t.describe()
+	description.TableStatus = aws.String(dynamodb.TableStatusDeleting)
+	return &dynamodb.DeleteTableOutput{
+		TableDescription: description,
+	}, nil
+}
+
+// DescribeTable describes table, see DescribeTableWithContext
+func (receiver *DB) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return receiver.DescribeTableWithContext(aws.BackgroundContext(), input)
+}
+
+// DescribeTableWithContext returns description of table
+func (receiver *DB) DescribeTableWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, _ ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.DescribeTableOutput{
+		Table: t.describe(),
+	}, nil
+}
+
+// WaitUntilTableExists returns nil if table exists, see WaitUntilTableExistsWithContext
+func (receiver *DB) WaitUntilTableExists(input *dynamodb.DescribeTableInput) error {
+	return receiver.WaitUntilTableExistsWithContext(aws.BackgroundContext(), input)
+}
+
+// WaitUntilTableExistsWithContext returns nil if table exists, tables never change on their own,
+// so it doesn't wait and returns error immediately if table doesn't exist
+func (receiver *DB) WaitUntilTableExistsWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, _ ...request.WaiterOption) error {
+	_, err := receiver.DescribeTableWithContext(ctx, input)
+	if isResourceNotFound(err) {
+		return awserr.New(request.WaiterResourceNotReadyErrorCode, "failed waiting for successful resource state", err)
+	}
+	return err
+}
+
+// WaitUntilTableNotExists returns nil if table doesn't exist, see WaitUntilTableNotExistsWithContext
+func (receiver *DB) WaitUntilTableNotExists(input *dynamodb.DescribeTableInput) error {
+	return receiver.WaitUntilTableNotExistsWithContext(aws.BackgroundContext(), input)
+}
+
+// WaitUntilTableNotExistsWithContext returns nil if table doesn't exist, tables never change on their own,
+// so it doesn't wait and returns error immediately if table exists
+func (receiver *DB) WaitUntilTableNotExistsWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, _ ...request.WaiterOption) error {
+	_, err := receiver.DescribeTableWithContext(ctx, input)
+	if isResourceNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return awserr.New(request.WaiterResourceNotReadyErrorCode, "failed waiting for successful resource state", nil)
+}
+
+// UpdateTableWithContext creates and deletes global secondary indexes and changes billing mode and throughput.
+// Created indexes are active immediately.
+func (receiver *DB) UpdateTableWithContext(ctx aws.Context, input *dynamodb.UpdateTableInput, _ ...request.Option) (*dynamodb.UpdateTableOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	description := copyValue(t.description).(*dynamodb.TableDescription)
+
+	for _, definition := range input.AttributeDefinitions {
+		if !hasAttributeDefinition(description.AttributeDefinitions, *definition.AttributeName) {
+			description.AttributeDefinitions = append(description.AttributeDefinitions, definition)
+		}
+	}
+	mode := billingMode(description.BillingModeSummary.BillingMode)
+	if input.BillingMode != nil {
+		if *input.BillingMode == dynamodb.BillingModeProvisioned && mode != dynamodb.BillingModeProvisioned && input.ProvisionedThroughput == nil {
+			return nil, validationError("One or more parameter values were invalid: ProvisionedThroughput must be specified when BillingMode is PROVISIONED")
+		}
+		mode = *input.BillingMode
+	}
+	if input.ProvisionedThroughput != nil {
+		if err := checkThroughput(mode, input.ProvisionedThroughput); err != nil {
+			return nil, err
+		}
+	}
+	for _, indexUpdate := range input.GlobalSecondaryIndexUpdates {
+		switch {
+		case indexUpdate.Create != nil:
+			create := indexUpdate.Create
+			if findIndex(description, *create.IndexName) != nil {
+				return nil, validationError(fmt.Sprintf("Index %s already exists", *create.IndexName))
+			}
+			if err := checkKeys(create.KeySchema, description.AttributeDefinitions); err != nil {
+				return nil, err
+			}
+			if err := checkThroughput(mode, create.ProvisionedThroughput); err != nil {
+				return nil, err
+			}
+			description.GlobalSecondaryIndexes = append(description.GlobalSecondaryIndexes, indexDescription(&dynamodb.GlobalSecondaryIndex{
+				IndexName:             create.IndexName,
+				KeySchema:             create.KeySchema,
+				Projection:            create.Projection,
+				ProvisionedThroughput: create.ProvisionedThroughput,
+			}))
+		case indexUpdate.Delete != nil:
+			name := aws.StringValue(indexUpdate.Delete.IndexName)
+			if findIndex(description, name) == nil {
+				return nil, &dynamodb.ResourceNotFoundException{
+					Message_: aws.String(fmt.Sprintf("Requested resource not found: Index: %s not found", name)),
+				}
+			}
+			var indexes []*dynamodb.GlobalSecondaryIndexDescription
+			for _, index := range description.GlobalSecondaryIndexes {
+				if aws.StringValue(index.IndexName) != name {
+					indexes = append(indexes, index)
+				}
+			}
+			description.GlobalSecondaryIndexes = indexes
+		}
+	}
+	if input.BillingMode != nil {
+		description.BillingModeSummary = &dynamodb.BillingModeSummary{
+			BillingMode: input.BillingMode,
+		}
+	}
+	if input.ProvisionedThroughput != nil {
+		description.ProvisionedThroughput = throughputDescription(input.ProvisionedThroughput)
+	}
+	if input.StreamSpecification != nil {
+		description.StreamSpecification = input.StreamSpecification
+	}
+
+	t.description = copyValue(description).(*dynamodb.TableDescription)
+
+	return &dynamodb.UpdateTableOutput{
+		TableDescription: t.describe(),
+	}, nil
+}
+
+// UpdateTimeToLiveWithContext enables or disables Time To Live, items are never expired
+func (receiver *DB) UpdateTimeToLiveWithContext(ctx aws.Context, input *dynamodb.UpdateTimeToLiveInput, _ ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := *input.TimeToLiveSpecification.Enabled
+	if enabled == (t.timeToLive != nil) {
+		return nil, validationError("TimeToLive is already enabled or disabled")
+	}
+	if enabled {
+		t.timeToLive = &dynamodb.TimeToLiveDescription{
+			AttributeName:    input.TimeToLiveSpecification.AttributeName,
+			TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusEnabled),
+		}
+	} else {
+		t.timeToLive = nil
+	}
+
+	return &dynamodb.UpdateTimeToLiveOutput{
+		TimeToLiveSpecification: input.TimeToLiveSpecification,
+	}, nil
+}
+
+// DescribeTimeToLiveWithContext returns Time To Live settings of table
+func (receiver *DB) DescribeTimeToLiveWithContext(ctx aws.Context, input *dynamodb.DescribeTimeToLiveInput, _ ...request.Option) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	description := &dynamodb.TimeToLiveDescription{
+		TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusDisabled),
+	}
+	if t.timeToLive != nil {
+		description = copyValue(t.timeToLive).(*dynamodb.TimeToLiveDescription)
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{
+		TimeToLiveDescription: description,
+	}, nil
+}
+
+// UpdateContinuousBackupsWithContext enables or disables point in time recovery, no backups are made
+func (receiver *DB) UpdateContinuousBackupsWithContext(ctx aws.Context, input *dynamodb.UpdateContinuousBackupsInput, _ ...request.Option) (*dynamodb.UpdateContinuousBackupsOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	t.pointInTimeRecovery = *input.PointInTimeRecoverySpecification.PointInTimeRecoveryEnabled
+
+	return &dynamodb.UpdateContinuousBackupsOutput{
+		ContinuousBackupsDescription: t.continuousBackups(),
+	}, nil
+}
+
+// DescribeContinuousBackupsWithContext returns point in time recovery settings of table
+func (receiver *DB) DescribeContinuousBackupsWithContext(ctx aws.Context, input *dynamodb.DescribeContinuousBackupsInput, _ ...request.Option) (*dynamodb.DescribeContinuousBackupsOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.DescribeContinuousBackupsOutput{
+		ContinuousBackupsDescription: t.continuousBackups(),
+	}, nil
+}
+
+// GetItem returns item, see GetItemWithContext
+func (receiver *DB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return receiver.GetItemWithContext(aws.BackgroundContext(), input)
+}
+
+// GetItemWithContext returns item by its key, Item of output is nil if it doesn't exist
+func (receiver *DB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+	p := newPlaceholders(input.ExpressionAttributeNames, nil)
+	projection, err := projectionOf(input.ProjectionExpression, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.unused(); err != nil {
+		return nil, err
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(input.Key, true)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &dynamodb.GetItemOutput{}
+	if existing, ok := t.items[key]; ok {
+		output.Item = project(existing, projection)
+	}
+	return output, nil
+}
+
+// PutItem writes item, see PutItemWithContext
+func (receiver *DB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return receiver.PutItemWithContext(aws.BackgroundContext(), input)
+}
+
+// PutItemWithContext writes item if condition expression is satisfied by existing item
+func (receiver *DB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+	p := newPlaceholders(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	c, err := conditionOf(input.ConditionExpression, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.unused(); err != nil {
+		return nil, err
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(input.Item, false)
+	if err != nil {
+		return nil, err
+	}
+	existing := t.items[key]
+	if !c(existing) {
+		return nil, conditionalCheckFailed()
+	}
+	t.items[key] = copyItem(input.Item)
+
+	output := &dynamodb.PutItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld && existing != nil {
+		output.Attributes = copyItem(existing)
+	}
+	return output, nil
+}
+
+// UpdateItem updates item, see UpdateItemWithContext
+func (receiver *DB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return receiver.UpdateItemWithContext(aws.BackgroundContext(), input)
+}
+
+// UpdateItemWithContext applies update expression to item if condition expression is satisfied,
+// item is created if it doesn't exist
+func (receiver *DB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, _ ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+	p := newPlaceholders(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	c, err := conditionOf(input.ConditionExpression, p)
+	if err != nil {
+		return nil, err
+	}
+	u, err := updateOf(input.UpdateExpression, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.unused(); err != nil {
+		return nil, err
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, existing, updated, err := t.update(input.Key, c, u)
+	if err != nil {
+		return nil, err
+	}
+	t.items[key] = updated
+
+	output := &dynamodb.UpdateItemOutput{}
+	switch aws.StringValue(input.ReturnValues) {
+	case dynamodb.ReturnValueAllOld:
+		if existing != nil {
+			output.Attributes = copyItem(existing)
+		}
+	case dynamodb.ReturnValueAllNew:
+		output.Attributes = copyItem(updated)
+	}
+	return output, nil
+}
+
+// DeleteItem deletes item, see DeleteItemWithContext
+func (receiver *DB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return receiver.DeleteItemWithContext(aws.BackgroundContext(), input)
+}
+
+// DeleteItemWithContext deletes item if condition expression is satisfied, deleting missing item isn't an error
+func (receiver *DB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, _ ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+	p := newPlaceholders(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	c, err := conditionOf(input.ConditionExpression, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.unused(); err != nil {
+		return nil, err
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(input.Key, true)
+	if err != nil {
+		return nil, err
+	}
+	existing := t.items[key]
+	if !c(existing) {
+		return nil, conditionalCheckFailed()
+	}
+	delete(t.items, key)
+
+	output := &dynamodb.DeleteItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld && existing != nil {
+		output.Attributes = existing
+	}
+	return output, nil
+}
+
+// TransactWriteItemsWithContext applies all writes if all their conditions are satisfied, otherwise nothing
+// is written and dynamodb.TransactionCanceledException with reason of every write is returned
+func (receiver *DB) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, _ ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	writes := make([]write, 0, len(input.TransactItems))
+	reasons := make([]*dynamodb.CancellationReason, 0, len(input.TransactItems))
+	failed := false
+	seen := map[*table]map[string]bool{}
+
+	for _, transactItem := range input.TransactItems {
+		var (
+			w   write
+			ok  bool
+			err error
+		)
+		switch {
+		case transactItem.Put != nil:
+			put := transactItem.Put
+			w, ok, err = receiver.transactCheck(put.TableName, put.Item, false, put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues)
+			w.item = copyItem(put.Item)
+		case transactItem.Delete != nil:
+			del := transactItem.Delete
+			w, ok, err = receiver.transactCheck(del.TableName, del.Key, true, del.ConditionExpression, del.ExpressionAttributeNames, del.ExpressionAttributeValues)
+		case transactItem.ConditionCheck != nil:
+			check := transactItem.ConditionCheck
+			w, ok, err = receiver.transactCheck(check.TableName, check.Key, true, check.ConditionExpression, check.ExpressionAttributeNames, check.ExpressionAttributeValues)
+			w.check = true
+		case transactItem.Update != nil:
+			w, ok, err = receiver.transactUpdate(transactItem.Update)
+		default:
+			err = validationError("TransactItems can only contain one of Check, Put, Update or Delete")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[w.t] == nil {
+			seen[w.t] = map[string]bool{}
+		}
+		if seen[w.t][w.key] {
+			return nil, validationError("Transaction request cannot include multiple operations on one item")
+		}
+		seen[w.t][w.key] = true
+
+		reason := &dynamodb.CancellationReason{
+			Code: aws.String("None"),
+		}
+		if !ok {
+			reason.Code = aws.String("ConditionalCheckFailed")
+			reason.Message = aws.String("The conditional request failed")
+			failed = true
+		}
+		reasons = append(reasons, reason)
+		writes = append(writes, w)
+	}
+
+	if failed {
+		codes := make([]string, 0, len(reasons))
+		for _, reason := range reasons {
+			codes = append(codes, *reason.Code)
+		}
+		return nil, &dynamodb.TransactionCanceledException{
+			Message_:            aws.String(fmt.Sprintf("Transaction cancelled, please refer cancellation reasons for specific reasons [%s]", strings.Join(codes, ", "))),
+			CancellationReasons: reasons,
+		}
+	}
+
+	for _, w := range writes {
+		w.apply()
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// write is a put or delete of one item
+type write struct {
+	t   *table
+	key string
+	// item is the new item, nil deletes it
+	item item
+	// check is true for condition checks of transaction, which write nothing
+	check bool
+}
+
+func (receiver write) apply() {
+	switch {
+	case receiver.check:
+	case receiver.item == nil:
+		delete(receiver.t.items, receiver.key)
+	default:
+		receiver.t.items[receiver.key] = receiver.item
+	}
+}
+
+// transactCheck evaluates condition of put, delete or condition check of transaction against existing item
+func (receiver *DB) transactCheck(tableName *string, it item, keyOnly bool, conditionExpression *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (write, bool, error) {
+	p := newPlaceholders(names, values)
+	c, err := conditionOf(conditionExpression, p)
+	if err != nil {
+		return write{}, false, err
+	}
+	if err := p.unused(); err != nil {
+		return write{}, false, err
+	}
+	t, err := receiver.table(tableName)
+	if err != nil {
+		return write{}, false, err
+	}
+	key, err := t.key(it, keyOnly)
+	if err != nil {
+		return write{}, false, err
+	}
+	return write{t: t, key: key}, c(t.items[key]), nil
+}
+
+// transactUpdate evaluates update of transaction against existing item
+func (receiver *DB) transactUpdate(input *dynamodb.Update) (write, bool, error) {
+	p := newPlaceholders(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	c, err := conditionOf(input.ConditionExpression, p)
+	if err != nil {
+		return write{}, false, err
+	}
+	u, err := updateOf(input.UpdateExpression, p)
+	if err != nil {
+		return write{}, false, err
+	}
+	if err := p.unused(); err != nil {
+		return write{}, false, err
+	}
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return write{}, false, err
+	}
+	key, err := t.key(input.Key, true)
+	if err != nil {
+		return write{}, false, err
+	}
+	_, _, updated, err := t.update(input.Key, c, u)
+	if isConditionalCheckFailed(err) {
+		return write{t: t, key: key, check: true}, false, nil
+	}
+	if err != nil {
+		return write{}, false, err
+	}
+	return write{t: t, key: key, item: updated}, true, nil
+}
+
+// BatchWriteItemWithContext puts and deletes items, all items are always processed
+func (receiver *DB) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, _ ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	var writes []write
+	for tableName, requests := range input.RequestItems {
+		t, err := receiver.table(aws.String(tableName))
+		if err != nil {
+			return nil, err
+		}
+		if len(requests) > 25 {
+			return nil, validationError("Too many items requested for the BatchWriteItem call")
+		}
+		keys := map[string]bool{}
+		for _, writeRequest := range requests {
+			w := write{t: t}
+			switch {
+			case writeRequest.PutRequest != nil:
+				w.key, err = t.key(writeRequest.PutRequest.Item, false)
+				w.item = copyItem(writeRequest.PutRequest.Item)
+			case writeRequest.DeleteRequest != nil:
+				w.key, err = t.key(writeRequest.DeleteRequest.Key, true)
+			default:
+				err = validationError("WriteRequest must contain PutRequest or DeleteRequest")
+			}
+			if err != nil {
+				return nil, err
+			}
+			if keys[w.key] {
+				return nil, validationError("Provided list of item keys contains duplicates")
+			}
+			keys[w.key] = true
+			writes = append(writes, w)
+		}
+	}
+
+	for _, w := range writes {
+		w.apply()
+	}
+	return &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: map[string][]*dynamodb.WriteRequest{},
+	}, nil
+}
+
+// Query queries table or index, see QueryWithContext
+func (receiver *DB) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return receiver.QueryWithContext(aws.BackgroundContext(), input)
+}
+
+// QueryWithContext returns items of table or global secondary index matching key condition and filter expressions
+func (receiver *DB) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, _ ...request.Option) (*dynamodb.QueryOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+	if input.KeyConditionExpression == nil {
+		return nil, validationError("KeyConditionExpression is required")
+	}
+	r := read{
+		indexName:         input.IndexName,
+		limit:             input.Limit,
+		exclusiveStartKey: input.ExclusiveStartKey,
+		backward:          input.ScanIndexForward != nil && !*input.ScanIndexForward,
+	}
+	err := r.parse(input.KeyConditionExpression, input.FilterExpression, input.ProjectionExpression,
+		newPlaceholders(input.ExpressionAttributeNames, input.ExpressionAttributeValues))
+	if err != nil {
+		return nil, err
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	page, err := t.read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.QueryOutput{
+		Items:            page.items,
+		Count:            aws.Int64(int64(len(page.items))),
+		ScannedCount:     aws.Int64(page.scanned),
+		LastEvaluatedKey: page.lastEvaluatedKey,
+	}, nil
+}
+
+// QueryPagesWithContext calls fn with every page of query until fn returns false
+func (receiver *DB) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, _ ...request.Option) error {
+	params := *input
+	for {
+		output, err := receiver.QueryWithContext(ctx, &params)
+		if err != nil {
+			return err
+		}
+		lastPage := len(output.LastEvaluatedKey) == 0
+		if !fn(output, lastPage) || lastPage {
+			return nil
+		}
+		params.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// Scan scans table or index, see ScanWithContext
+func (receiver *DB) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	return receiver.ScanWithContext(aws.BackgroundContext(), input)
+}
+
+// ScanWithContext returns items of table or global secondary index matching filter expression.
+// Items are ordered by their keys and split to segments by their position.
+func (receiver *DB) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, _ ...request.Option) (*dynamodb.ScanOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := input.Validate(); err != nil {
+		return nil, validationError(err.Error())
+	}
+	if (input.Segment == nil) != (input.TotalSegments == nil) {
+		return nil, validationError("Segment and TotalSegments must be used together")
+	}
+	if input.Segment != nil && *input.Segment >= *input.TotalSegments {
+		return nil, validationError("Segment must be less than TotalSegments")
+	}
+
+	r := read{
+		indexName:         input.IndexName,
+		limit:             input.Limit,
+		exclusiveStartKey: input.ExclusiveStartKey,
+		segment:           aws.Int64Value(input.Segment),
+		totalSegments:     aws.Int64Value(input.TotalSegments),
+	}
+	err := r.parse(nil, input.FilterExpression, input.ProjectionExpression,
+		newPlaceholders(input.ExpressionAttributeNames, input.ExpressionAttributeValues))
+	if err != nil {
+		return nil, err
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	t, err := receiver.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	page, err := t.read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.ScanOutput{
+		Items:            page.items,
+		Count:            aws.Int64(int64(len(page.items))),
+		ScannedCount:     aws.Int64(page.scanned),
+		LastEvaluatedKey: page.lastEvaluatedKey,
+	}, nil
+}
+
+// ScanPagesWithContext calls fn with every page of scan until fn returns false
+func (receiver *DB) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, _ ...request.Option) error {
+	params := *input
+	for {
+		output, err := receiver.ScanWithContext(ctx, &params)
+		if err != nil {
+			return err
+		}
+		lastPage := len(output.LastEvaluatedKey) == 0
+		if !fn(output, lastPage) || lastPage {
+			return nil
+		}
+		params.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// table returns table by its name, must be called with mutex locked
+func (receiver *DB) table(tableName *string) (*table, error) {
+	t, ok := receiver.tables[aws.StringValue(tableName)]
+	if !ok {
+		return nil, &dynamodb.ResourceNotFoundException{
+			Message_: aws.String("Cannot do operations on a non-existent table"),
+		}
+	}
+	return t, nil
+}
+
+// describe returns copy of table description with current item count
+func (receiver *table) describe() *dynamodb.TableDescription {
+	description := copyValue(receiver.description).(*dynamodb.TableDescription)
+	description.ItemCount = aws.Int64(int64(len(receiver.items)))
+	for _, index := range description.GlobalSecondaryIndexes {
+		count := int64(0)
+		for _, it := range receiver.items {
+			if hasKeys(it, index.KeySchema) {
+				count++
+			}
+		}
+		index.ItemCount = aws.Int64(count)
+	}
+	return description
+}
+
+func (receiver *table) continuousBackups() *dynamodb.ContinuousBackupsDescription {
+	status := dynamodb.PointInTimeRecoveryStatusDisabled
+	if receiver.pointInTimeRecovery {
+		status = dynamodb.PointInTimeRecoveryStatusEnabled
+	}
+	return &dynamodb.ContinuousBackupsDescription{
+		ContinuousBackupsStatus: aws.String(dynamodb.ContinuousBackupsStatusEnabled),
+		PointInTimeRecoveryDescription: &dynamodb.PointInTimeRecoveryDescription{
+			PointInTimeRecoveryStatus: aws.String(status),
+		},
+	}
+}
+
+// key validates key attributes of item against key schema and returns keyString of item,
+// if keyOnly is true other attributes are not allowed
+func (receiver *table) key(it item, keyOnly bool) (string, error) {
+	types := attributeTypes(receiver.description.AttributeDefinitions)
+	for _, element := range receiver.description.KeySchema {
+		name := *element.AttributeName
+		value, ok := it[name]
+		if !ok || value == nil {
+			return "", validationError(fmt.Sprintf("One of the required keys was not given a value: %s", name))
+		}
+		if valueType(value) != types[name] {
+			return "", validationError(fmt.Sprintf("Type mismatch for key %s expected: %s", name, types[name]))
+		}
+	}
+	if keyOnly && len(it) != len(receiver.description.KeySchema) {
+		return "", validationError("The provided key element does not match the schema")
+	}
+	return keyString(it, receiver.description.KeySchema), nil
+}
+
+// update applies update expression to item with key if condition is satisfied and returns
+// keyString, existing item (nil if it doesn't exist) and updated item, which isn't stored
+func (receiver *table) update(keyItem item, c condition, u update) (string, item, item, error) {
+	key, err := receiver.key(keyItem, true)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	existing := receiver.items[key]
+	if !c(existing) {
+		return "", nil, nil, conditionalCheckFailed()
+	}
+
+	source := existing
+	if source == nil {
+		source = keyItem
+	}
+	updated := copyItem(source)
+	if err := u(source, updated); err != nil {
+		return "", nil, nil, validationError(err.Error())
+	}
+	if newKey, err := receiver.key(updated, false); err != nil || newKey != key {
+		return "", nil, nil, validationError("Cannot update attribute which is part of the key")
+	}
+	return key, existing, copyItem(updated), nil
+}
+
+// read is Query or Scan request
+type read struct {
+	indexName         *string
+	keyCondition      condition
+	filter            condition
+	projection        []string
+	limit             *int64
+	exclusiveStartKey item
+	backward          bool
+	segment           int64
+	totalSegments     int64
+}
+
+// readPage is the result of read
+type readPage struct {
+	items            []item
+	scanned          int64
+	lastEvaluatedKey item
+}
+
+// candidate is an item with its position in table or index
+type candidate struct {
+	position string
+	item     item
+}
+
+// parse parses expressions of Query or Scan, key condition expression is nil for Scan
+func (receiver *read) parse(keyConditionExpression *string, filterExpression *string, projectionExpression *string, p *placeholders) error {
+	var err error
+	if keyConditionExpression != nil {
+		if receiver.keyCondition, err = conditionOf(keyConditionExpression, p); err != nil {
+			return err
+		}
+	}
+	if receiver.filter, err = conditionOf(filterExpression, p); err != nil {
+		return err
+	}
+	if receiver.projection, err = projectionOf(projectionExpression, p); err != nil {
+		return err
+	}
+	return p.unused()
+}
+
+// read evaluates Query or Scan against items of table or index
+func (receiver *table) read(r read) (readPage, error) {
+	keySchema := receiver.description.KeySchema
+	var index *dynamodb.GlobalSecondaryIndexDescription
+	if r.indexName != nil {
+		if index = findIndex(receiver.description, *r.indexName); index == nil {
+			return readPage{}, validationError(fmt.Sprintf("The table does not have the specified index: %s", *r.indexName))
+		}
+	}
+
+	position := func(it item) string {
+		if index == nil {
+			return keyString(it, keySchema)
+		}
+		return keyString(it, index.KeySchema) + "\x01" + keyString(it, keySchema)
+	}
+
+	var candidates []candidate
+	for _, it := range receiver.items {
+		if index != nil {
+			if !hasKeys(it, index.KeySchema) {
+				continue
+			}
+			it = indexProjection(it, index, keySchema)
+		}
+		candidates = append(candidates, candidate{position: position(it), item: it})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].position < candidates[j].position
+	})
+
+	if r.totalSegments > 0 {
+		size := (int64(len(candidates)) + r.totalSegments - 1) / r.totalSegments
+		start, end := r.segment*size, (r.segment+1)*size
+		if start > int64(len(candidates)) {
+			start = int64(len(candidates))
+		}
+		if end > int64(len(candidates)) {
+			end = int64(len(candidates))
+		}
+		candidates = candidates[start:end]
+	}
+	if r.keyCondition != nil {
+		var matching []candidate
+		for _, candidate := range candidates {
+			if r.keyCondition(candidate.item) {
+				matching = append(matching, candidate)
+			}
+		}
+		candidates = matching
+	}
+	if r.backward {
+		for i, j := 0, len(candidates)-1; i < j; i, j = i+1, j-1 {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		}
+	}
+	if len(r.exclusiveStartKey) > 0 {
+		start := position(r.exclusiveStartKey)
+		for len(candidates) > 0 && (candidates[0].position == start || (candidates[0].position < start) != r.backward) {
+			candidates = candidates[1:]
+		}
+	}
+
+	var page readPage
+	for i, candidate := range candidates {
+		if r.limit != nil && page.scanned == *r.limit {
+			last := candidates[i-1].item
+			page.lastEvaluatedKey = map[string]*dynamodb.AttributeValue{}
+			for _, element := range keySchema {
+				page.lastEvaluatedKey[*element.AttributeName] = copyValue(last[*element.AttributeName]).(*dynamodb.AttributeValue)
+			}
+			if index != nil {
+				for _, element := range index.KeySchema {
+					page.lastEvaluatedKey[*element.AttributeName] = copyValue(last[*element.AttributeName]).(*dynamodb.AttributeValue)
+				}
+			}
+			break
+		}
+		page.scanned++
+		if r.filter(candidate.item) {
+			page.items = append(page.items, project(candidate.item, r.projection))
+		}
+	}
+	return page, nil
+}
+
+// indexProjection returns attributes of item projected to index
+func indexProjection(it item, index *dynamodb.GlobalSecondaryIndexDescription, tableKeySchema []*dynamodb.KeySchemaElement) item {
+	projectionType := dynamodb.ProjectionTypeAll
+	if index.Projection != nil && index.Projection.ProjectionType != nil {
+		projectionType = *index.Projection.ProjectionType
+	}
+	if projectionType == dynamodb.ProjectionTypeAll {
+		return it
+	}
+
+	projected := item{}
+	for _, keySchema := range [][]*dynamodb.KeySchemaElement{tableKeySchema, index.KeySchema} {
+		for _, element := range keySchema {
+			projected[*element.AttributeName] = it[*element.AttributeName]
+		}
+	}
+	if projectionType == dynamodb.ProjectionTypeInclude {
+		for _, name := range index.Projection.NonKeyAttributes {
+			if value, ok := it[*name]; ok {
+				projected[*name] = value
+			}
+		}
+	}
+	return projected
+}
+
+// project returns copy of item with projected attributes only, all attributes if projection is nil
+func project(it item, projection []string) item {
+	if projection == nil {
+		return copyItem(it)
+	}
+	projected := item{}
+	for _, name := range projection {
+		if value, ok := it[name]; ok {
+			projected[name] = copyValue(value).(*dynamodb.AttributeValue)
+		}
+	}
+	return projected
+}
+
+// conditionOf parses optional condition expression, missing expression is always satisfied
+func conditionOf(text *string, p *placeholders) (condition, error) {
+	if text == nil {
+		return func(item) bool {
+			return true
+		}, nil
+	}
+	c, err := parseCondition(*text, p)
+	if err != nil {
+		return nil, validationError(fmt.Sprintf("Invalid expression %q: %s", *text, err))
+	}
+	return func(it item) bool {
+		if it == nil {
+			it = item{}
+		}
+		return c(it)
+	}, nil
+}
+
+func updateOf(text *string, p *placeholders) (update, error) {
+	if text == nil {
+		return func(source item, target item) error {
+			return nil
+		}, nil
+	}
+	u, err := parseUpdate(*text, p)
+	if err != nil {
+		return nil, validationError(fmt.Sprintf("Invalid UpdateExpression %q: %s", *text, err))
+	}
+	return u, nil
+}
+
+func projectionOf(text *string, p *placeholders) ([]string, error) {
+	if text == nil {
+		return nil, nil
+	}
+	projection, err := parseProjection(*text, p)
+	if err != nil {
+		return nil, validationError(fmt.Sprintf("Invalid ProjectionExpression %q: %s", *text, err))
+	}
+	return projection, nil
+}
+
+// checkKeys checks that all key attributes are defined as scalar attributes
+func checkKeys(keySchema []*dynamodb.KeySchemaElement, definitions []*dynamodb.AttributeDefinition) error {
+	types := attributeTypes(definitions)
+	for _, element := range keySchema {
+		switch types[aws.StringValue(element.AttributeName)] {
+		case dynamodb.ScalarAttributeTypeS, dynamodb.ScalarAttributeTypeN, dynamodb.ScalarAttributeTypeB:
+		default:
+			return validationError(fmt.Sprintf("Key attribute %s is not defined in AttributeDefinitions", aws.StringValue(element.AttributeName)))
+		}
+	}
+	return nil
+}
+
+// checkThroughput checks that throughput of table or index is given only for tables with provisioned billing mode
+func checkThroughput(mode string, throughput *dynamodb.ProvisionedThroughput) error {
+	if mode == dynamodb.BillingModePayPerRequest && throughput != nil {
+		return validationError("One or more parameter values were invalid: Neither ReadCapacityUnits nor WriteCapacityUnits can be specified when BillingMode is PAY_PER_REQUEST")
+	}
+	if mode == dynamodb.BillingModeProvisioned && throughput == nil {
+		return validationError("One or more parameter values were invalid: ReadCapacityUnits and WriteCapacityUnits must both be specified when BillingMode is PROVISIONED")
+	}
+	return nil
+}
+
+func attributeTypes(definitions []*dynamodb.AttributeDefinition) map[string]string {
+	types := map[string]string{}
+	for _, definition := range definitions {
+		types[aws.StringValue(definition.AttributeName)] = aws.StringValue(definition.AttributeType)
+	}
+	return types
+}
+
+func hasAttributeDefinition(definitions []*dynamodb.AttributeDefinition, name string) bool {
+	_, ok := attributeTypes(definitions)[name]
+	return ok
+}
+
+// hasKeys reports whether item has all key attributes, items without them are not in index
+func hasKeys(it item, keySchema []*dynamodb.KeySchemaElement) bool {
+	for _, element := range keySchema {
+		if value, ok := it[*element.AttributeName]; !ok || valueType(value) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// keyString returns string identifying item by its key attributes, items are ordered by it,
+// so numbers are ordered as strings
+func keyString(it item, keySchema []*dynamodb.KeySchemaElement) string {
+	parts := make([]string, 0, len(keySchema))
+	for _, element := range keySchema {
+		value := it[*element.AttributeName]
+		switch {
+		case value == nil:
+			parts = append(parts, "")
+		case value.S != nil:
+			parts = append(parts, *value.S)
+		case value.N != nil:
+			parts = append(parts, *value.N)
+		default:
+			parts = append(parts, string(value.B))
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// valueType returns type of scalar attribute value, empty for other types
+func valueType(value *dynamodb.AttributeValue) string {
+	switch {
+	case value == nil:
+		return ""
+	case value.S != nil:
+		return dynamodb.ScalarAttributeTypeS
+	case value.N != nil:
+		return dynamodb.ScalarAttributeTypeN
+	case value.B != nil:
+		return dynamodb.ScalarAttributeTypeB
+	}
+	return ""
+}
+
+func findIndex(description *dynamodb.TableDescription, name string) *dynamodb.GlobalSecondaryIndexDescription {
+	for _, index := range description.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexName) == name {
+			return index
+		}
+	}
+	return nil
+}
+
+func indexDescription(index *dynamodb.GlobalSecondaryIndex) *dynamodb.GlobalSecondaryIndexDescription {
+	return &dynamodb.GlobalSecondaryIndexDescription{
+		IndexName:             index.IndexName,
+		IndexStatus:           aws.String(dynamodb.IndexStatusActive),
+		KeySchema:             index.KeySchema,
+		Projection:            index.Projection,
+		ProvisionedThroughput: throughputDescription(index.ProvisionedThroughput),
+	}
+}
+
+func throughputDescription(throughput *dynamodb.ProvisionedThroughput) *dynamodb.ProvisionedThroughputDescription {
+	description := &dynamodb.ProvisionedThroughputDescription{
+		ReadCapacityUnits:  aws.Int64(0),
+		WriteCapacityUnits: aws.Int64(0),
+	}
+	if throughput != nil {
+		description.ReadCapacityUnits = throughput.ReadCapacityUnits
+		description.WriteCapacityUnits = throughput.WriteCapacityUnits
+	}
+	return description
+}
+
+func billingMode(mode *string) string {
+	if mode == nil {
+		return dynamodb.BillingModeProvisioned
+	}
+	return *mode
+}
+
+// copyItem returns deep copy of item, so stored items can't be changed by callers
+func copyItem(it item) item {
+	if it == nil {
+		return nil
+	}
+	copied := make(item, len(it))
+	for name, value := range it {
+		copied[name] = copyValue(value).(*dynamodb.AttributeValue)
+	}
+	return copied
+}
+
+func copyValue(value interface{}) interface{} {
+	if reflect.ValueOf(value).IsNil() {
+		return value
+	}
+	return awsutil.CopyOf(value)
+}
+
+// checkContext returns the error of canceled request if ctx is done
+func checkContext(ctx aws.Context) error {
+	if err := ctx.Err(); err != nil {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	return nil
+}
+
+func validationError(message string) error {
+	return awserr.New(errCodeValidation, message, nil)
+}
+
+func conditionalCheckFailed() error {
+	return &dynamodb.ConditionalCheckFailedException{
+		Message_: aws.String("The conditional request failed"),
+	}
+}
+
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func isResourceNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException
+}
@@ -0,0 +1,469 @@
+package fakedynamodb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func createTable(t *testing.T, db *DB) {
+	_, err := db.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String("tokens"),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("token"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("client_id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("token"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("client_id"),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("client_id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+				},
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly)},
+				ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+					ReadCapacityUnits:  aws.Int64(1),
+					WriteCapacityUnits: aws.Int64(1),
+				},
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+	assert.Nil(t, err, "%s", err)
+}
+
+func putToken(t *testing.T, db *DB, token string, clientID string) {
+	it := item{
+		"token": {S: aws.String(token)},
+		"scope": {S: aws.String("read")},
+	}
+	if clientID != "" {
+		it["client_id"] = &dynamodb.AttributeValue{S: aws.String(clientID)}
+	}
+	_, err := db.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("tokens"),
+		Item:      it,
+	})
+	assert.Nil(t, err, "%s", err)
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+func TestCreateTable(t *testing.T) {
+	t.Parallel()
+	db := New()
+	createTable(t, db)
+
+	_, err := db.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String("tokens"),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("token"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("token"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+	})
+	assert.Equal(t, dynamodb.ErrCodeResourceInUseException, errorCode(err))
+
+	resp, err := db.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String("tokens")})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, dynamodb.TableStatusActive, *resp.Table.TableStatus)
+	assert.Equal(t, dynamodb.IndexStatusActive, *resp.Table.GlobalSecondaryIndexes[0].IndexStatus)
+
+	_, err = db.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String("tokens")})
+	assert.Nil(t, err, "%s", err)
+	_, err = db.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String("tokens")})
+	assert.Equal(t, dynamodb.ErrCodeResourceNotFoundException, errorCode(err))
+}
+
+func TestConditionAndProjection(t *testing.T) {
+	t.Parallel()
+	db := New()
+	createTable(t, db)
+	putToken(t, db, "a", "client")
+
+	_, err := db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String("tokens"),
+		Item:                item{"token": {S: aws.String("a")}},
+		ConditionExpression: aws.String("attribute_not_exists(#token)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#token": aws.String("token"),
+		},
+	})
+	assert.Equal(t, dynamodb.ErrCodeConditionalCheckFailedException, errorCode(err))
+
+	_, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String("tokens"),
+		Key:                 item{"token": {S: aws.String("a")}},
+		ConditionExpression: aws.String("client_id = :client_id AND NOT begins_with(#scope, :prefix)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#scope": aws.String("scope"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":client_id": {S: aws.String("client")},
+			":prefix":    {S: aws.String("re")},
+		},
+	})
+	assert.Equal(t, dynamodb.ErrCodeConditionalCheckFailedException, errorCode(err))
+
+	resp, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:            aws.String("tokens"),
+		Key:                  item{"token": {S: aws.String("a")}},
+		ProjectionExpression: aws.String("#scope, expires_at"),
+		ExpressionAttributeNames: map[string]*string{
+			"#scope": aws.String("scope"),
+		},
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, item{"scope": {S: aws.String("read")}}, resp.Item)
+
+	// returned items are copies
+	*resp.Item["scope"].S = "write"
+	resp, err = db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String("tokens"),
+		Key:       item{"token": {S: aws.String("a")}},
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, "read", *resp.Item["scope"].S)
+
+	_, err = db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String("tokens"),
+		Key:       item{"token": {N: aws.String("1")}},
+	})
+	assert.Equal(t, errCodeValidation, errorCode(err))
+}
+
+func TestUpdateItem(t *testing.T) {
+	t.Parallel()
+	db := New()
+	createTable(t, db)
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String("tokens"),
+		Key:                 item{"token": {S: aws.String("a")}},
+		UpdateExpression:    aws.String("SET version = if_not_exists(version, :zero) + :one, #scope = :scope REMOVE client_id"),
+		ConditionExpression: aws.String("attribute_not_exists(version) OR version < :max"),
+		ExpressionAttributeNames: map[string]*string{
+			"#scope": aws.String("scope"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zero":  {N: aws.String("0")},
+			":one":   {N: aws.String("1")},
+			":max":   {N: aws.String("2")},
+			":scope": {S: aws.String("read")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	}
+	resp, err := db.UpdateItem(input)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, "1", *resp.Attributes["version"].N)
+
+	resp, err = db.UpdateItem(input)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, item{
+		"token":   {S: aws.String("a")},
+		"version": {N: aws.String("2")},
+		"scope":   {S: aws.String("read")},
+	}, resp.Attributes)
+
+	_, err = db.UpdateItem(input)
+	assert.Equal(t, dynamodb.ErrCodeConditionalCheckFailedException, errorCode(err))
+}
+
+func TestUpdateNestedItem(t *testing.T) {
+	t.Parallel()
+	db := New()
+	createTable(t, db)
+	_, err := db.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("tokens"),
+		Item: item{
+			"token": {S: aws.String("a")},
+			"client": {M: item{
+				"Id":     {S: aws.String("1234")},
+				"Secret": {S: aws.String("secret")},
+			}},
+		},
+	})
+	assert.Nil(t, err, "%s", err)
+
+	resp, err := db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String("tokens"),
+		Key:                 item{"token": {S: aws.String("a")}},
+		UpdateExpression:    aws.String("SET #client.RedirectUri = :uri REMOVE #client.Secret"),
+		ConditionExpression: aws.String("attribute_exists(#client.Id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#client": aws.String("client"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":uri": {S: aws.String("/dev/null")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, item{
+		"Id":          {S: aws.String("1234")},
+		"RedirectUri": {S: aws.String("/dev/null")},
+	}, resp.Attributes["client"].M)
+
+	// parent of nested attribute must exist
+	_, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String("tokens"),
+		Key:              item{"token": {S: aws.String("a")}},
+		UpdateExpression: aws.String("SET scopes.#read = :true"),
+		ExpressionAttributeNames: map[string]*string{
+			"#read": aws.String("read"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":true": {BOOL: aws.Bool(true)},
+		},
+	})
+	assert.Equal(t, "ValidationException", errorCode(err))
+}
+
+func TestTransactWriteItems(t *testing.T) {
+	t.Parallel()
+	db := New()
+	createTable(t, db)
+	putToken(t, db, "a", "client")
+
+	_, err := db.TransactWriteItemsWithContext(context.Background(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Put: &dynamodb.Put{
+					TableName: aws.String("tokens"),
+					Item:      item{"token": {S: aws.String("b")}},
+				},
+			},
+			{
+				Delete: &dynamodb.Delete{
+					TableName:           aws.String("tokens"),
+					Key:                 item{"token": {S: aws.String("c")}},
+					ConditionExpression: aws.String("attribute_exists(#token)"),
+					ExpressionAttributeNames: map[string]*string{
+						"#token": aws.String("token"),
+					},
+				},
+			},
+		},
+	})
+	cancelled, ok := err.(*dynamodb.TransactionCanceledException)
+	if assert.True(t, ok, "%s", err) {
+		assert.Equal(t, "None", *cancelled.CancellationReasons[0].Code)
+		assert.Equal(t, "ConditionalCheckFailed", *cancelled.CancellationReasons[1].Code)
+	}
+
+	resp, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String("tokens"),
+		Key:       item{"token": {S: aws.String("b")}},
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Nil(t, resp.Item)
+
+	_, err = db.TransactWriteItemsWithContext(context.Background(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Put: &dynamodb.Put{
+					TableName: aws.String("tokens"),
+					Item:      item{"token": {S: aws.String("b")}},
+				},
+			},
+			{
+				Delete: &dynamodb.Delete{
+					TableName:           aws.String("tokens"),
+					Key:                 item{"token": {S: aws.String("a")}},
+					ConditionExpression: aws.String("attribute_exists(#token)"),
+					ExpressionAttributeNames: map[string]*string{
+						"#token": aws.String("token"),
+					},
+				},
+			},
+		},
+	})
+	assert.Nil(t, err, "%s", err)
+
+	out, err := db.Scan(&dynamodb.ScanInput{TableName: aws.String("tokens")})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, []item{{"token": {S: aws.String("b")}}}, out.Items)
+}
+
+func TestQueryAndScanPages(t *testing.T) {
+	t.Parallel()
+	db := New()
+	createTable(t, db)
+	for _, token := range []string{"a", "b", "c", "d", "e"} {
+		putToken(t, db, token, "client")
+	}
+	putToken(t, db, "f", "")
+	putToken(t, db, "g", "other")
+
+	var tokens []string
+	err := db.QueryPagesWithContext(context.Background(), &dynamodb.QueryInput{
+		TableName:              aws.String("tokens"),
+		IndexName:              aws.String("client_id"),
+		KeyConditionExpression: aws.String("client_id = :client_id"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":client_id": {S: aws.String("client")},
+		},
+		Limit: aws.Int64(2),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, it := range page.Items {
+			// index is KEYS_ONLY
+			assert.Len(t, it, 2)
+			tokens = append(tokens, *it["token"].S)
+		}
+		return true
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, tokens)
+
+	// items without client_id are not in index
+	out, err := db.Scan(&dynamodb.ScanInput{
+		TableName: aws.String("tokens"),
+		IndexName: aws.String("client_id"),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Len(t, out.Items, 6)
+
+	scanned := map[string]bool{}
+	for segment := int64(0); segment < 3; segment++ {
+		err = db.ScanPagesWithContext(context.Background(), &dynamodb.ScanInput{
+			TableName:        aws.String("tokens"),
+			Segment:          aws.Int64(segment),
+			TotalSegments:    aws.Int64(3),
+			Limit:            aws.Int64(1),
+			FilterExpression: aws.String("attribute_exists(client_id) AND client_id <> :other"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":other": {S: aws.String("other")},
+			},
+		}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, it := range page.Items {
+				assert.False(t, scanned[*it["token"].S])
+				scanned[*it["token"].S] = true
+			}
+			return true
+		})
+		assert.Nil(t, err, "%s", err)
+	}
+	assert.Len(t, scanned, 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.ScanWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String("tokens")})
+	assert.NotNil(t, err)
+}
+
+func TestValidation(t *testing.T) {
+	t.Parallel()
+	db := New()
+	createTable(t, db)
+	putToken(t, db, "a", "client")
+
+	// reserved words must be aliased
+	_, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:            aws.String("tokens"),
+		Key:                  item{"token": {S: aws.String("a")}},
+		ProjectionExpression: aws.String("token"),
+	})
+	assert.Equal(t, errCodeValidation, errorCode(err))
+	_, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String("tokens"),
+		Item:                item{"token": {S: aws.String("b")}},
+		ConditionExpression: aws.String("attribute_not_exists(token)"),
+	})
+	assert.Equal(t, errCodeValidation, errorCode(err))
+
+	// all names and values must be used
+	_, err = db.GetItem(&dynamodb.GetItemInput{
+		TableName:            aws.String("tokens"),
+		Key:                  item{"token": {S: aws.String("a")}},
+		ProjectionExpression: aws.String("client_id"),
+		ExpressionAttributeNames: map[string]*string{
+			"#token": aws.String("token"),
+		},
+	})
+	assert.Equal(t, errCodeValidation, errorCode(err))
+	_, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String("tokens"),
+		Key:       item{"token": {S: aws.String("a")}},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":client_id": {S: aws.String("client")},
+		},
+	})
+	assert.Equal(t, errCodeValidation, errorCode(err))
+
+	// batch can't write the same item twice
+	_, err = db.BatchWriteItemWithContext(context.Background(), &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]*dynamodb.WriteRequest{
+			"tokens": {
+				{PutRequest: &dynamodb.PutRequest{Item: item{"token": {S: aws.String("b")}}}},
+				{DeleteRequest: &dynamodb.DeleteRequest{Key: item{"token": {S: aws.String("b")}}}},
+			},
+		},
+	})
+	assert.Equal(t, errCodeValidation, errorCode(err))
+
+	// throughput can't be given for on-demand tables and must be given for provisioned ones
+	index := &dynamodb.GlobalSecondaryIndex{
+		IndexName: aws.String("client_id"),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("client_id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly)},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	}
+	input := &dynamodb.CreateTableInput{
+		TableName:   aws.String("on-demand"),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("token"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("client_id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("token"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{index},
+	}
+	_, err = db.CreateTable(input)
+	assert.Equal(t, errCodeValidation, errorCode(err))
+	input.GlobalSecondaryIndexes = nil
+	_, err = db.CreateTable(input)
+	assert.Nil(t, err, "%s", err)
+	_, err = db.UpdateTableWithContext(context.Background(), &dynamodb.UpdateTableInput{
+		TableName: aws.String("on-demand"),
+		GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+			{
+				Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+					IndexName:             index.IndexName,
+					KeySchema:             index.KeySchema,
+					Projection:            index.Projection,
+					ProvisionedThroughput: index.ProvisionedThroughput,
+				},
+			},
+		},
+	})
+	assert.Equal(t, errCodeValidation, errorCode(err))
+
+	_, err = db.CreateTable(&dynamodb.CreateTableInput{
+		TableName:            aws.String("provisioned"),
+		AttributeDefinitions: input.AttributeDefinitions,
+		KeySchema:            input.KeySchema,
+	})
+	assert.Equal(t, errCodeValidation, errorCode(err))
+}
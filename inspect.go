@@ -0,0 +1,100 @@
+package osindynamodb
+
+import (
+	"context"
+
+	"github.com/RangelReale/osin"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// InspectAuthorize looks up AuthorizeData by a code without consuming it or checking its expiration.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) InspectAuthorize(code string) (*osin.AuthorizeData, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.InspectAuthorizeWithContext(ctx, code)
+}
+
+// InspectAuthorizeWithContext is the same as InspectAuthorize with the ability to pass a context.
+func (receiver *Storage) InspectAuthorizeWithContext(ctx context.Context, code string) (*osin.AuthorizeData, error) {
+	item, err := receiver.inspectItem(ctx, authorizeEntity, code)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrAuthorizeNotFound
+	}
+
+	return receiver.authorizeFromItem(item, code)
+}
+
+// InspectAccess looks up AccessData by an access token without checking its expiration.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) InspectAccess(token string) (*osin.AccessData, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.InspectAccessWithContext(ctx, token)
+}
+
+// InspectAccessWithContext is the same as InspectAccess with the ability to pass a context.
+func (receiver *Storage) InspectAccessWithContext(ctx context.Context, token string) (*osin.AccessData, error) {
+	item, err := receiver.inspectItem(ctx, accessEntity, token)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrAccessNotFound
+	}
+
+	accessData, err := receiver.decodeAccess(item, accessEntity)
+	if err != nil {
+		return nil, err
+	}
+	// raw token isn't persisted if HashTokens is enabled
+	accessData.AccessToken = token
+	return accessData, nil
+}
+
+// InspectRefresh looks up AccessData by a refresh token without checking its expiration.
+// Unlike LoadRefresh it never updates the token nor revokes its family, rotated tokens are returned too.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) InspectRefresh(token string) (*osin.AccessData, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.InspectRefreshWithContext(ctx, token)
+}
+
+// InspectRefreshWithContext is the same as InspectRefresh with the ability to pass a context.
+func (receiver *Storage) InspectRefreshWithContext(ctx context.Context, token string) (*osin.AccessData, error) {
+	item, err := receiver.inspectItem(ctx, refreshEntity, token)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrRefreshNotFound
+	}
+
+	accessData, err := receiver.decodeAccess(item, refreshEntity)
+	if err != nil {
+		return nil, err
+	}
+	// raw token isn't persisted if HashTokens is enabled
+	accessData.RefreshToken = token
+	return accessData, nil
+}
+
+// inspectItem returns item of e stored under token, nil if it doesn't exist
+func (receiver *Storage) inspectItem(ctx context.Context, e entity, token string) (map[string]*dynamodb.AttributeValue, error) {
+	resp, err := receiver.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		Key:       receiver.itemKey(e, receiver.tokenKey(token)),
+		TableName: receiver.tableName(e),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+	return resp.Item, nil
+}
@@ -0,0 +1,261 @@
+package osindynamodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// SchemaAction is a kind of change made by EnsureSchema
+type SchemaAction string
+
+const (
+	// SchemaActionCreateTable creates missing table together with its indexes
+	SchemaActionCreateTable SchemaAction = "CreateTable"
+	// SchemaActionCreateIndex adds missing global secondary index to existing table
+	SchemaActionCreateIndex SchemaAction = "CreateIndex"
+	// SchemaActionEnableTimeToLive enables DynamoDB Time To Live on TTLAttribute
+	SchemaActionEnableTimeToLive SchemaAction = "EnableTimeToLive"
+	// SchemaActionEnablePointInTimeRecovery enables continuous backups configured by TableOptions
+	SchemaActionEnablePointInTimeRecovery SchemaAction = "EnablePointInTimeRecovery"
+)
+
+// SchemaChange is a change made or planned by EnsureSchema
+type SchemaChange struct {
+	// Table is the name of changed table
+	Table string
+	// Action is the kind of change
+	Action SchemaAction
+	// Name is the name of created index or Time To Live attribute, empty for other actions
+	Name string
+}
+
+// EnsureSchema brings tables to the layout created by CreateSchema and returns the list of changes.
+// Missing tables are created, missing indexes, Time To Live and point in time recovery are added
+// to existing tables, everything else is left untouched, so it's safe to call it on every start.
+// Billing mode, throughput, encryption, streams and tags of existing tables are not changed.
+// If dryRun is true nothing is changed and the planned changes are returned.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) EnsureSchema(dryRun bool) ([]SchemaChange, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.EnsureSchemaWithContext(ctx, dryRun)
+}
+
+// EnsureSchemaWithContext is the same as EnsureSchema with the ability to pass a context.
+func (receiver *Storage) EnsureSchemaWithContext(ctx context.Context, dryRun bool) ([]SchemaChange, error) {
+	ttlTables := map[string]bool{}
+	for _, tableName := range receiver.ttlTables() {
+		ttlTables[tableName] = true
+	}
+
+	var changes []SchemaChange
+	for _, createParams := range receiver.schema() {
+		tableName := *createParams.TableName
+		tableChanges, err := receiver.ensureTable(ctx, createParams, ttlTables[tableName], dryRun)
+		changes = append(changes, tableChanges...)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, nil
+}
+
+// ensureTable creates table defined by createParams or adds whatever it's missing
+func (receiver *Storage) ensureTable(ctx context.Context, createParams *dynamodb.CreateTableInput, ttl bool, dryRun bool) ([]SchemaChange, error) {
+	var changes []SchemaChange
+	tableName := *createParams.TableName
+	apply := func(change SchemaChange, run func() error) error {
+		changes = append(changes, change)
+		if dryRun {
+			return nil
+		}
+		return run()
+	}
+
+	resp, err := receiver.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	exists := true
+	if isResourceNotFound(err) {
+		exists = false
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		err := apply(SchemaChange{Table: tableName, Action: SchemaActionCreateTable}, func() error {
+			return createTable(ctx, receiver.db, createParams)
+		})
+		if err != nil {
+			return changes, err
+		}
+	} else {
+		existing := map[string]bool{}
+		for _, index := range resp.Table.GlobalSecondaryIndexes {
+			existing[aws.StringValue(index.IndexName)] = true
+		}
+		for _, index := range createParams.GlobalSecondaryIndexes {
+			if existing[*index.IndexName] {
+				continue
+			}
+			index := index
+			err := apply(SchemaChange{Table: tableName, Action: SchemaActionCreateIndex, Name: *index.IndexName}, func() error {
+				return receiver.createIndex(ctx, createParams, resp.Table, index)
+			})
+			if err != nil {
+				return changes, err
+			}
+		}
+	}
+
+	if ttl {
+		enabled := false
+		if exists {
+			resp, err := receiver.db.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{
+				TableName: aws.String(tableName),
+			})
+			if err != nil {
+				return changes, err
+			}
+			enabled = timeToLiveEnabled(resp.TimeToLiveDescription, receiver.ttlAttribute())
+		}
+		if !enabled {
+			err := apply(SchemaChange{Table: tableName, Action: SchemaActionEnableTimeToLive, Name: receiver.ttlAttribute()}, func() error {
+				return enableTimeToLive(ctx, receiver.db, tableName, receiver.ttlAttribute())
+			})
+			if err != nil {
+				return changes, err
+			}
+		}
+	}
+
+	if receiver.tableOptions(tableName).PointInTimeRecovery {
+		enabled := false
+		if exists {
+			resp, err := receiver.db.DescribeContinuousBackupsWithContext(ctx, &dynamodb.DescribeContinuousBackupsInput{
+				TableName: aws.String(tableName),
+			})
+			if err != nil {
+				return changes, err
+			}
+			enabled = pointInTimeRecoveryEnabled(resp.ContinuousBackupsDescription)
+		}
+		if !enabled {
+			err := apply(SchemaChange{Table: tableName, Action: SchemaActionEnablePointInTimeRecovery}, func() error {
+				return enablePointInTimeRecovery(ctx, receiver.db, tableName)
+			})
+			if err != nil {
+				return changes, err
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// createIndex adds index defined in createParams to existing table and waits until it's active.
+// Throughput of the index follows billing mode of the table, not the one configured by TableOptions.
+func (receiver *Storage) createIndex(ctx context.Context, createParams *dynamodb.CreateTableInput, table *dynamodb.TableDescription, index *dynamodb.GlobalSecondaryIndex) error {
+	keyAttributes := map[string]bool{}
+	for _, key := range index.KeySchema {
+		keyAttributes[*key.AttributeName] = true
+	}
+	var attributeDefinitions []*dynamodb.AttributeDefinition
+	for _, definition := range createParams.AttributeDefinitions {
+		if keyAttributes[*definition.AttributeName] {
+			attributeDefinitions = append(attributeDefinitions, definition)
+		}
+	}
+
+	params := &dynamodb.UpdateTableInput{
+		TableName:            createParams.TableName,
+		AttributeDefinitions: attributeDefinitions,
+		GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+			{
+				Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+					IndexName:             index.IndexName,
+					KeySchema:             index.KeySchema,
+					Projection:            index.Projection,
+					ProvisionedThroughput: receiver.indexThroughput(table, index),
+				},
+			},
+		},
+	}
+	if _, err := receiver.db.UpdateTableWithContext(ctx, params); err != nil {
+		return err
+	}
+
+	// only one index can be created at a time, wait for backfill to finish
+	for attempt := uint(0); ; attempt++ {
+		resp, err := receiver.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+			TableName: createParams.TableName,
+		})
+		if err != nil {
+			return err
+		}
+		if indexActive(resp.Table, *index.IndexName) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(attempt + 3)):
+		}
+	}
+}
+
+// indexThroughput returns throughput of index added to existing table, nil if the table is billed per request
+func (receiver *Storage) indexThroughput(table *dynamodb.TableDescription, index *dynamodb.GlobalSecondaryIndex) *dynamodb.ProvisionedThroughput {
+	if table.BillingModeSummary != nil && aws.StringValue(table.BillingModeSummary.BillingMode) == dynamodb.BillingModePayPerRequest {
+		return nil
+	}
+	if index.ProvisionedThroughput != nil {
+		return index.ProvisionedThroughput
+	}
+	return receiver.tableOptions(aws.StringValue(table.TableName)).provisionedThroughput()
+}
+
+// indexActive reports whether table and its index indexName are active
+func indexActive(table *dynamodb.TableDescription, indexName string) bool {
+	if aws.StringValue(table.TableStatus) != dynamodb.TableStatusActive {
+		return false
+	}
+	for _, index := range table.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexName) == indexName {
+			return aws.StringValue(index.IndexStatus) == dynamodb.IndexStatusActive
+		}
+	}
+	return false
+}
+
+// timeToLiveEnabled reports whether Time To Live is enabled or being enabled on attributeName
+func timeToLiveEnabled(description *dynamodb.TimeToLiveDescription, attributeName string) bool {
+	if description == nil || aws.StringValue(description.AttributeName) != attributeName {
+		return false
+	}
+	status := aws.StringValue(description.TimeToLiveStatus)
+	return status == dynamodb.TimeToLiveStatusEnabled || status == dynamodb.TimeToLiveStatusEnabling
+}
+
+// pointInTimeRecoveryEnabled reports whether continuous backups with point in time recovery are enabled
+func pointInTimeRecoveryEnabled(description *dynamodb.ContinuousBackupsDescription) bool {
+	if description == nil || description.PointInTimeRecoveryDescription == nil {
+		return false
+	}
+	status := aws.StringValue(description.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus)
+	return status == dynamodb.PointInTimeRecoveryStatusEnabled
+}
+
+// isResourceNotFound reports whether err is caused by missing table
+func isResourceNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == dynamodb.ErrCodeResourceNotFoundException
+	}
+	return false
+}
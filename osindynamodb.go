@@ -1,15 +1,27 @@
 package osindynamodb
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"strconv"
 	"time"
 
 	"github.com/RangelReale/osin"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 )
 
+// DefaultTTLAttribute is the name of attribute used for DynamoDB Time To Live
+// when StorageConfig.TTLAttribute is empty
+const DefaultTTLAttribute = "expires_at"
+
+// DefaultRotatedRefreshTokenLifetime is how long rotated refresh tokens are kept
+// when StorageConfig.RotatedRefreshTokenLifetime is zero
+const DefaultRotatedRefreshTokenLifetime = 30 * 24 * time.Hour
+
 var (
 	// ErrClientNotFound is returned by GetClient if client was not found
 	ErrClientNotFound = osin.ErrNotFound
@@ -21,10 +33,19 @@ var (
 	ErrRefreshNotFound = osin.ErrNotFound
 	// ErrTokenExpired is returned by LoadAccess, LoadAuthorize or LoadRefresh if token or code expired
 	ErrTokenExpired = errors.New("Token expired")
+	// ErrClientExists is returned by CreateClient if client with the same id exists and ConditionalWrites is enabled
+	ErrClientExists = errors.New("Client already exists")
+	// ErrTokenExists is returned by SaveAccess, SaveAuthorize or SaveRefresh if token or code exists and ConditionalWrites is enabled
+	ErrTokenExists = errors.New("Token already exists")
+	// ErrRefreshTokenReused is returned by LoadRefresh or SaveAccess if already rotated refresh token was used again.
+	// If RefreshTokenRotation is enabled, all tokens of its family are revoked.
+	ErrRefreshTokenReused = errors.New("Refresh token reused")
 )
 
 // New returns a new DynamoDB storage instance.
-func New(db *dynamodb.DynamoDB, config StorageConfig) *Storage {
+// Any implementation of dynamodbiface.DynamoDBAPI can be passed as db,
+// e.g. *dynamodb.DynamoDB, a DAX client or a fake for tests.
+func New(db dynamodbiface.DynamoDBAPI, config StorageConfig) *Storage {
 	return &Storage{
 		db:     db,
 		config: config,
@@ -35,7 +56,7 @@ func New(db *dynamodb.DynamoDB, config StorageConfig) *Storage {
 // with Amazon DynamoDB (https://aws.amazon.com/dynamodb/)
 // using aws-sdk-go (https://github.com/aws/aws-sdk-go).
 type Storage struct {
-	db     *dynamodb.DynamoDB
+	db     dynamodbiface.DynamoDBAPI
 	config StorageConfig
 }
 
@@ -49,6 +70,21 @@ type StorageConfig struct {
 	AccessTable string
 	// RefreshTable is the name of table for refresh tokens
 	RefreshTable string
+	// SingleTable is the name of table for clients, authorization codes, access and refresh tokens together.
+	// If set, ClientTable, AuthorizeTable, AccessTable and RefreshTable are ignored and items are keyed
+	// by pk (e.g. CLIENT#id, ACCESS#token) and sk (e.g. CLIENT, ACCESS) attributes.
+	SingleTable string
+	// TableOptions configures tables created by CreateSchema (billing mode, encryption, backups, streams, tags).
+	// It's used for SingleTable and for tables without their own options below.
+	TableOptions TableOptions
+	// ClientTableOptions overrides TableOptions for ClientTable if set
+	ClientTableOptions *TableOptions
+	// AuthorizeTableOptions overrides TableOptions for AuthorizeTable if set
+	AuthorizeTableOptions *TableOptions
+	// AccessTableOptions overrides TableOptions for AccessTable if set
+	AccessTableOptions *TableOptions
+	// RefreshTableOptions overrides TableOptions for RefreshTable if set
+	RefreshTableOptions *TableOptions
 	// CreateUserData is a function that allows you to create struct
 	// to which osin.AccessData.UserData will be json.Unmarshaled.
 	// Example:
@@ -59,6 +95,75 @@ type StorageConfig struct {
 	// 	return &AppUserData{}
 	// }
 	CreateUserData func() interface{}
+	// CreateClient is a function that allows you to create struct
+	// to which clients are json.Unmarshaled in GetClient and in Load methods.
+	// It must return a pointer. If nil, *osin.DefaultClient is used.
+	// Example:
+	// struct AppClient{
+	// 	osin.DefaultClient
+	// 	Scopes []string
+	// }
+	// func() osin.Client {
+	// 	return &AppClient{}
+	// }
+	CreateClient func() osin.Client
+	// TTLAttribute is the name of numeric attribute holding expiration time (unix epoch)
+	// of authorization codes, access and refresh tokens.
+	// CreateSchema enables DynamoDB Time To Live on this attribute.
+	// If empty DefaultTTLAttribute is used.
+	TTLAttribute string
+	// RefreshTokenLifetime is absolute lifetime of refresh tokens counted from the grant, i.e. from
+	// AccessData.CreatedAt of the first refresh token. Refreshed tokens inherit it in granted_at attribute.
+	// Zero means refresh tokens never expire.
+	RefreshTokenLifetime time.Duration
+	// RefreshTokenIdleLifetime is sliding lifetime of refresh tokens counted from their last use
+	// tracked in last_used_at attribute. Zero means refresh tokens don't expire when not used.
+	RefreshTokenIdleLifetime time.Duration
+	// HashTokens enables storing SHA-256 hashes of authorization codes, access and refresh tokens
+	// as hash keys instead of raw values. Raw values are not persisted in json attribute either,
+	// so tokens other than the one used for lookup are returned as references accepted only by Remove methods.
+	HashTokens bool
+	// TokenPepper is a secret key used with HashTokens. If set, HMAC-SHA256 is used instead of SHA-256.
+	TokenPepper []byte
+	// HashClientSecrets enables storing bcrypt hashes of client secrets instead of raw values.
+	// GetClient returns such clients as *HashedSecretClient.
+	HashClientSecrets bool
+	// ClientSecretCost is the bcrypt cost used with HashClientSecrets. If zero bcrypt.DefaultCost is used.
+	ClientSecretCost int
+	// Encrypter encrypts json attribute of all items if set. See AESGCMKeyring.
+	// Items written without encryption stay readable. It can't be used with AttributesEncoding.
+	Encrypter Encrypter
+	// Encoding selects how items are stored, JSONEncoding or AttributesEncoding.
+	// If empty JSONEncoding is used.
+	Encoding Encoding
+	// ConsumeAuthorizeOnLoad makes LoadAuthorize atomically delete the authorization code
+	// with ConsumeAuthorize, so concurrent requests can't exchange the same code twice.
+	ConsumeAuthorizeOnLoad bool
+	// RemovePreviousRefreshOnSave makes SaveAccess delete refresh token of previous AccessData
+	// (set by osin on refresh) in the same transaction as new tokens are written.
+	RemovePreviousRefreshOnSave bool
+	// RefreshTokenRotation enables refresh token families with reuse detection.
+	// Family id is carried from previous refresh token to the new one and rotated tokens are kept
+	// as tombstones (RemoveRefresh marks them with rotated_at instead of deleting). When rotated token
+	// is presented again, all access and refresh tokens of its family are revoked.
+	// Takes precedence over RemovePreviousRefreshOnSave.
+	RefreshTokenRotation bool
+	// RotatedRefreshTokenLifetime is how long rotated refresh tokens are kept to detect their reuse,
+	// counted from rotation. Tokens already expiring by RefreshTokenLifetime or RefreshTokenIdleLifetime
+	// keep their expiration. If zero DefaultRotatedRefreshTokenLifetime is used.
+	RotatedRefreshTokenLifetime time.Duration
+	// UserIDAttribute is the name of string attribute written by UserData.ToAttributeValues
+	// which identifies the user. If set, CreateSchema creates UserIndex on AccessTable and RefreshTable
+	// used by RevokeUserTokens and ListUserGrants.
+	UserIDAttribute string
+	// CascadeRemoveClient makes RemoveClient revoke all tokens of the client with RevokeClientTokens.
+	CascadeRemoveClient bool
+	// ConditionalWrites makes CreateClient, SaveAuthorize, SaveAccess and SaveRefresh
+	// return ErrClientExists or ErrTokenExists instead of overwriting existing items.
+	ConditionalWrites bool
+	// DefaultTimeout limits DynamoDB calls made by methods which don't accept context.Context,
+	// e.g. the ones called by osin. Zero means no timeout.
+	DefaultTimeout time.Duration
 }
 
 // UserData is an interface that allows you to store UserData values
@@ -68,9 +173,86 @@ type UserData interface {
 	ToAttributeValues() map[string]*dynamodb.AttributeValue
 }
 
+// UserDataDecoder is an optional counterpart of UserData. If struct returned by StorageConfig.CreateUserData
+// implements it, LoadAccess and LoadRefresh hydrate UserData from attributes written by ToAttributeValues
+// instead of the json attribute.
+type UserDataDecoder interface {
+	// FromAttributeValues reads user data from attribute values of DynamoDB item
+	FromAttributeValues(map[string]*dynamodb.AttributeValue) error
+}
+
 // CreateSchema initiates db with basic schema layout
 // This is not a part of interface but can be useful for initiating basic schema and for tests
 func (receiver *Storage) CreateSchema() error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.CreateSchemaWithContext(ctx)
+}
+
+// CreateSchemaWithContext is the same as CreateSchema with the ability to pass a context.
+func (receiver *Storage) CreateSchemaWithContext(ctx context.Context) error {
+	createParams := receiver.schema()
+	for i := range createParams {
+		if err := createTable(ctx, receiver.db, createParams[i]); err != nil {
+			return err
+		}
+	}
+
+	for _, tableName := range receiver.ttlTables() {
+		if err := enableTimeToLive(ctx, receiver.db, tableName, receiver.ttlAttribute()); err != nil {
+			return err
+		}
+	}
+
+	for i := range createParams {
+		tableName := *createParams[i].TableName
+		if !receiver.tableOptions(tableName).PointInTimeRecovery {
+			continue
+		}
+		if err := enablePointInTimeRecovery(ctx, receiver.db, tableName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DropSchema drops all tables
+// This is not a part of interface but can be useful in tests
+func (receiver *Storage) DropSchema() error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.DropSchemaWithContext(ctx)
+}
+
+// DropSchemaWithContext is the same as DropSchema with the ability to pass a context.
+func (receiver *Storage) DropSchemaWithContext(ctx context.Context) error {
+	if receiver.usesSingleTable() {
+		return deleteTable(ctx, receiver.db, receiver.config.SingleTable)
+	}
+
+	tables := []string{
+		receiver.config.AccessTable,
+		receiver.config.AuthorizeTable,
+		receiver.config.RefreshTable,
+		receiver.config.ClientTable,
+	}
+	for i := range tables {
+		if err := deleteTable(ctx, receiver.db, tables[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schema returns definitions of all tables with TableOptions applied
+func (receiver *Storage) schema() []*dynamodb.CreateTableInput {
+	if receiver.usesSingleTable() {
+		params := receiver.singleTableSchema()
+		applyTableOptions(params, receiver.tableOptions(receiver.config.SingleTable))
+		return []*dynamodb.CreateTableInput{params}
+	}
+
 	createParams := []*dynamodb.CreateTableInput{
 		{
 			TableName: aws.String(receiver.config.AccessTable),
@@ -79,6 +261,14 @@ func (receiver *Storage) CreateSchema() error {
 					AttributeName: aws.String("token"),
 					AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
 				},
+				{
+					AttributeName: aws.String("family"),
+					AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+				},
+				{
+					AttributeName: aws.String("client_id"),
+					AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+				},
 			},
 			KeySchema: []*dynamodb.KeySchemaElement{
 				{
@@ -86,6 +276,10 @@ func (receiver *Storage) CreateSchema() error {
 					KeyType:       aws.String("HASH"),
 				},
 			},
+			GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+				keysOnlyIndex(FamilyIndex, "family"),
+				keysOnlyIndex(ClientIndex, "client_id"),
+			},
 			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
 				ReadCapacityUnits:  aws.Int64(1),
 				WriteCapacityUnits: aws.Int64(1),
@@ -98,6 +292,10 @@ func (receiver *Storage) CreateSchema() error {
 					AttributeName: aws.String("code"),
 					AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
 				},
+				{
+					AttributeName: aws.String("client_id"),
+					AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+				},
 			},
 			KeySchema: []*dynamodb.KeySchemaElement{
 				{
@@ -105,6 +303,9 @@ func (receiver *Storage) CreateSchema() error {
 					KeyType:       aws.String("HASH"),
 				},
 			},
+			GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+				keysOnlyIndex(ClientIndex, "client_id"),
+			},
 			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
 				ReadCapacityUnits:  aws.Int64(1),
 				WriteCapacityUnits: aws.Int64(1),
@@ -136,6 +337,14 @@ func (receiver *Storage) CreateSchema() error {
 					AttributeName: aws.String("token"),
 					AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
 				},
+				{
+					AttributeName: aws.String("family"),
+					AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+				},
+				{
+					AttributeName: aws.String("client_id"),
+					AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+				},
 			},
 			KeySchema: []*dynamodb.KeySchemaElement{
 				{
@@ -143,6 +352,10 @@ func (receiver *Storage) CreateSchema() error {
 					KeyType:       aws.String("HASH"),
 				},
 			},
+			GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+				keysOnlyIndex(FamilyIndex, "family"),
+				keysOnlyIndex(ClientIndex, "client_id"),
+			},
 			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
 				ReadCapacityUnits:  aws.Int64(1),
 				WriteCapacityUnits: aws.Int64(1),
@@ -150,34 +363,41 @@ func (receiver *Storage) CreateSchema() error {
 		},
 	}
 
-	for i := range createParams {
-		if err := createTable(receiver.db, createParams[i]); err != nil {
-			return err
+	if receiver.config.UserIDAttribute != "" {
+		for i := range createParams {
+			tableName := *createParams[i].TableName
+			if tableName != receiver.config.AccessTable && tableName != receiver.config.RefreshTable {
+				continue
+			}
+			createParams[i].AttributeDefinitions = append(createParams[i].AttributeDefinitions, &dynamodb.AttributeDefinition{
+				AttributeName: aws.String(receiver.config.UserIDAttribute),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			})
+			createParams[i].GlobalSecondaryIndexes = append(createParams[i].GlobalSecondaryIndexes, userIndex(receiver.config.UserIDAttribute))
 		}
 	}
 
-	return nil
+	for i := range createParams {
+		applyTableOptions(createParams[i], receiver.tableOptions(*createParams[i].TableName))
+	}
+
+	return createParams
 }
 
-// DropSchema drops all tables
-// This is not a part of interface but can be useful in tests
-func (receiver *Storage) DropSchema() error {
-	tables := []string{
+// ttlTables returns names of tables with DynamoDB Time To Live enabled
+func (receiver *Storage) ttlTables() []string {
+	if receiver.usesSingleTable() {
+		return []string{receiver.config.SingleTable}
+	}
+	return []string{
 		receiver.config.AccessTable,
 		receiver.config.AuthorizeTable,
 		receiver.config.RefreshTable,
-		receiver.config.ClientTable,
-	}
-	for i := range tables {
-		if err := deleteTable(receiver.db, tables[i]); err != nil {
-			return err
-		}
 	}
-	return nil
 }
 
-func createTable(db *dynamodb.DynamoDB, createParams *dynamodb.CreateTableInput) error {
-	_, err := db.CreateTable(createParams)
+func createTable(ctx context.Context, db dynamodbiface.DynamoDBAPI, createParams *dynamodb.CreateTableInput) error {
+	_, err := db.CreateTableWithContext(ctx, createParams)
 	if err != nil {
 		return err
 	}
@@ -185,18 +405,18 @@ func createTable(db *dynamodb.DynamoDB, createParams *dynamodb.CreateTableInput)
 	describeParams := &dynamodb.DescribeTableInput{
 		TableName: aws.String(*createParams.TableName),
 	}
-	if err := db.WaitUntilTableExists(describeParams); err != nil {
+	if err := db.WaitUntilTableExistsWithContext(ctx, describeParams); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func deleteTable(db *dynamodb.DynamoDB, tableName string) error {
+func deleteTable(ctx context.Context, db dynamodbiface.DynamoDBAPI, tableName string) error {
 	params := &dynamodb.DeleteTableInput{
 		TableName: aws.String(tableName),
 	}
-	_, err := db.DeleteTable(params)
+	_, err := db.DeleteTableWithContext(ctx, params)
 	if err != nil {
 		return err
 	}
@@ -204,13 +424,126 @@ func deleteTable(db *dynamodb.DynamoDB, tableName string) error {
 	describeParams := &dynamodb.DescribeTableInput{
 		TableName: aws.String(tableName),
 	}
-	if err := db.WaitUntilTableNotExists(describeParams); err != nil {
+	if err := db.WaitUntilTableNotExistsWithContext(ctx, describeParams); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// keysOnlyIndex returns definition of global secondary index with hash key attributeName
+func keysOnlyIndex(indexName string, attributeName string) *dynamodb.GlobalSecondaryIndex {
+	return &dynamodb.GlobalSecondaryIndex{
+		IndexName: aws.String(indexName),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(attributeName),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		Projection: &dynamodb.Projection{
+			ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly),
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	}
+}
+
+func enableTimeToLive(ctx context.Context, db dynamodbiface.DynamoDBAPI, tableName string, attributeName string) error {
+	params := &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(attributeName),
+			Enabled:       aws.Bool(true),
+		},
+	}
+	if _, err := db.UpdateTimeToLiveWithContext(ctx, params); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ttlAttribute returns name of attribute used for DynamoDB Time To Live
+func (receiver *Storage) ttlAttribute() string {
+	if receiver.config.TTLAttribute != "" {
+		return receiver.config.TTLAttribute
+	}
+	return DefaultTTLAttribute
+}
+
+// epochValue converts time to numeric attribute value (unix epoch) as used by DynamoDB Time To Live
+func epochValue(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(t.Unix(), 10)),
+	}
+}
+
+// epochAttribute returns time of attribute written by epochValue and whether it's present
+func epochAttribute(item map[string]*dynamodb.AttributeValue, name string) (time.Time, bool, error) {
+	value, ok := item[name]
+	if !ok || value.N == nil {
+		return time.Time{}, false, nil
+	}
+	epoch, err := strconv.ParseInt(*value.N, 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(epoch, 0), true, nil
+}
+
+// isConditionalCheckFailed reports whether err is caused by failed condition expression
+func isConditionalCheckFailed(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+// failedTransactionItems returns indexes of transaction items which condition expression failed
+func failedTransactionItems(err error) map[int]bool {
+	failed := map[int]bool{}
+	canceled, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok {
+		return failed
+	}
+	for i, reason := range canceled.CancellationReasons {
+		if aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+			failed[i] = true
+		}
+	}
+	return failed
+}
+
+// notExistsCondition returns condition expression preventing overwrite of existing item if ConditionalWrites is enabled,
+// key name is passed by notExistsNames as it can be a reserved word (e.g. token)
+func (receiver *Storage) notExistsCondition() *string {
+	if !receiver.config.ConditionalWrites {
+		return nil
+	}
+	return aws.String("attribute_not_exists(#key)")
+}
+
+// notExistsNames returns expression attribute names of notExistsCondition
+func (receiver *Storage) notExistsNames(keyName string) map[string]*string {
+	if !receiver.config.ConditionalWrites {
+		return nil
+	}
+	return map[string]*string{
+		"#key": aws.String(keyName),
+	}
+}
+
+// defaultContext returns context used by methods which don't accept context.Context
+func (receiver *Storage) defaultContext() (context.Context, context.CancelFunc) {
+	if receiver.config.DefaultTimeout > 0 {
+		return context.WithTimeout(context.Background(), receiver.config.DefaultTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
 // Clone the storage if needed. Has no effect with this library, it's only to satisfy interface.
 func (receiver *Storage) Clone() osin.Storage {
 	return receiver
@@ -224,24 +557,48 @@ func (receiver *Storage) Close() {
 // This is not a part of interface and as so, it's never used in osin flow.
 // However can be really usefull for applications to add new clients.
 func (receiver *Storage) CreateClient(client osin.Client) error {
-	data, err := json.Marshal(client)
-	if err != nil {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.CreateClientWithContext(ctx, client)
+}
+
+// CreateClientWithContext is the same as CreateClient with the ability to pass a context.
+func (receiver *Storage) CreateClientWithContext(ctx context.Context, client osin.Client) error {
+	items := map[string]*dynamodb.AttributeValue{
+		"id": {
+			S: aws.String(client.GetId()),
+		},
+		"version": {
+			N: aws.String("1"),
+		},
+	}
+
+	if receiver.config.HashClientSecrets {
+		secretHash, err := receiver.hashClientSecret(client.GetSecret())
+		if err != nil {
+			return err
+		}
+		items["secret_hash"] = &dynamodb.AttributeValue{
+			S: aws.String(secretHash),
+		}
+	}
+	if err := receiver.encodeClient(items, client); err != nil {
 		return err
 	}
+	receiver.setItemKey(items, clientEntity)
 
 	params := &dynamodb.PutItemInput{
-		Item: map[string]*dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(client.GetId()),
-			},
-			"json": {
-				S: aws.String(string(data)),
-			},
-		},
-		TableName: aws.String(receiver.config.ClientTable),
+		Item:                     items,
+		ConditionExpression:      receiver.notExistsCondition(),
+		ExpressionAttributeNames: receiver.notExistsNames("id"),
+		TableName:                receiver.tableName(clientEntity),
 	}
 
-	if _, err := receiver.db.PutItem(params); err != nil {
+	_, err := receiver.db.PutItemWithContext(ctx, params)
+	if isConditionalCheckFailed(err) {
+		return ErrClientExists
+	}
+	if err != nil {
 		return err
 	}
 
@@ -250,49 +607,76 @@ func (receiver *Storage) CreateClient(client osin.Client) error {
 
 // GetClient loads the client by id (client_id)
 func (receiver *Storage) GetClient(id string) (osin.Client, error) {
-	var client *osin.DefaultClient
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.GetClientWithContext(ctx, id)
+}
 
-	params := &dynamodb.GetItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(id),
-			},
-		},
-		ProjectionExpression: aws.String("id, json"),
-		TableName:            aws.String(receiver.config.ClientTable),
+// GetClientWithContext is the same as GetClient with the ability to pass a context.
+func (receiver *Storage) GetClientWithContext(ctx context.Context, id string) (osin.Client, error) {
+	client, _, err := receiver.GetClientWithVersionWithContext(ctx, id)
+	return client, err
+}
+
+// newClient returns client to which json is unmarshaled
+func (receiver *Storage) newClient() osin.Client {
+	if receiver.config.CreateClient != nil {
+		return receiver.config.CreateClient()
 	}
+	return &osin.DefaultClient{}
+}
 
-	resp, err := receiver.db.GetItem(params)
+// decodeClient converts client table item to osin.Client
+func (receiver *Storage) decodeClient(item map[string]*dynamodb.AttributeValue) (osin.Client, error) {
+	client := receiver.newClient()
+
+	data, err := receiver.clientPayload(item)
 	if err != nil {
 		return nil, err
 	}
-
-	if len(resp.Item) == 0 {
-		return nil, ErrClientNotFound
+	if data, err = receiver.applyClientUpdates(data, item); err != nil {
+		return nil, err
 	}
-
-	data := resp.Item["json"].S
-	err = json.Unmarshal([]byte(*data), &client)
+	err = json.Unmarshal(data, client)
 	if err != nil {
 		return nil, err
 	}
+	if secretHash, ok := item["secret_hash"]; ok {
+		if secretHash.S == nil {
+			return nil, errInvalidSecretHash
+		}
+		return &HashedSecretClient{
+			Client:     client,
+			SecretHash: *secretHash.S,
+		}, nil
+	}
 	return client, nil
 }
 
 // RemoveClient revokes or deletes client.
+// Tokens issued to the client are revoked too if CascadeRemoveClient is enabled.
 // This is not a part of interface and as so, it's never used in osin flow.
 // However can be really usefull for applications to remove or revoke clients.
 func (receiver *Storage) RemoveClient(id string) error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.RemoveClientWithContext(ctx, id)
+}
+
+// RemoveClientWithContext is the same as RemoveClient with the ability to pass a context.
+func (receiver *Storage) RemoveClientWithContext(ctx context.Context, id string) error {
+	if receiver.config.CascadeRemoveClient {
+		if err := receiver.RevokeClientTokensWithContext(ctx, id); err != nil {
+			return err
+		}
+	}
+
 	params := &dynamodb.DeleteItemInput{
-		TableName: aws.String(receiver.config.ClientTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(id),
-			},
-		},
+		TableName: receiver.tableName(clientEntity),
+		Key:       receiver.itemKey(clientEntity, id),
 	}
 
-	_, err := receiver.db.DeleteItem(params)
+	_, err := receiver.db.DeleteItemWithContext(ctx, params)
 	if err != nil {
 		return err
 	}
@@ -302,23 +686,36 @@ func (receiver *Storage) RemoveClient(id string) error {
 
 // SaveAuthorize saves authorize data.
 func (receiver *Storage) SaveAuthorize(authorizeData *osin.AuthorizeData) error {
-	data, err := json.Marshal(authorizeData)
-	if err != nil {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.SaveAuthorizeWithContext(ctx, authorizeData)
+}
+
+// SaveAuthorizeWithContext is the same as SaveAuthorize with the ability to pass a context.
+func (receiver *Storage) SaveAuthorizeWithContext(ctx context.Context, authorizeData *osin.AuthorizeData) error {
+	items := map[string]*dynamodb.AttributeValue{
+		"code": {
+			S: aws.String(receiver.tokenKey(authorizeData.Code)),
+		},
+		receiver.ttlAttribute(): epochValue(authorizeData.ExpireAt()),
+	}
+	if err := receiver.encodeAuthorize(items, authorizeData); err != nil {
 		return err
 	}
+	setClientID(items, authorizeData.Client)
+	receiver.setItemKey(items, authorizeEntity)
 	params := &dynamodb.PutItemInput{
-		Item: map[string]*dynamodb.AttributeValue{
-			"code": {
-				S: aws.String(authorizeData.Code),
-			},
-			"json": {
-				S: aws.String(string(data)),
-			},
-		},
-		TableName: aws.String(receiver.config.AuthorizeTable),
+		Item:                     items,
+		ConditionExpression:      receiver.notExistsCondition(),
+		ExpressionAttributeNames: receiver.notExistsNames("code"),
+		TableName:                receiver.tableName(authorizeEntity),
 	}
 
-	if _, err := receiver.db.PutItem(params); err != nil {
+	_, err := receiver.db.PutItemWithContext(ctx, params)
+	if isConditionalCheckFailed(err) {
+		return ErrTokenExists
+	}
+	if err != nil {
 		return err
 	}
 
@@ -329,17 +726,26 @@ func (receiver *Storage) SaveAuthorize(authorizeData *osin.AuthorizeData) error
 // Client information is loaded together.
 // Can return error if expired.
 func (receiver *Storage) LoadAuthorize(code string) (authorizeData *osin.AuthorizeData, err error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.LoadAuthorizeWithContext(ctx, code)
+}
+
+// LoadAuthorizeWithContext is the same as LoadAuthorize with the ability to pass a context.
+func (receiver *Storage) LoadAuthorizeWithContext(ctx context.Context, code string) (authorizeData *osin.AuthorizeData, err error) {
+	if receiver.config.ConsumeAuthorizeOnLoad {
+		return receiver.ConsumeAuthorizeWithContext(ctx, code)
+	}
+
+	projection, names := receiver.authorizeProjection()
 	params := &dynamodb.GetItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"code": {
-				S: aws.String(code),
-			},
-		},
-		ProjectionExpression: aws.String("json"),
-		TableName:            aws.String(receiver.config.AuthorizeTable),
+		Key:                      receiver.itemKey(authorizeEntity, receiver.tokenKey(code)),
+		ProjectionExpression:     projection,
+		ExpressionAttributeNames: names,
+		TableName:                receiver.tableName(authorizeEntity),
 	}
 
-	resp, err := receiver.db.GetItem(params)
+	resp, err := receiver.db.GetItemWithContext(ctx, params)
 	if err != nil {
 		return nil, err
 	}
@@ -348,10 +754,42 @@ func (receiver *Storage) LoadAuthorize(code string) (authorizeData *osin.Authori
 		return nil, ErrAuthorizeNotFound
 	}
 
-	authorizeData = &osin.AuthorizeData{}
-	authorizeData.Client = &osin.DefaultClient{}
-	data := resp.Item["json"].S
-	err = json.Unmarshal([]byte(*data), &authorizeData)
+	return receiver.decodeAuthorize(resp.Item, code)
+}
+
+// ConsumeAuthorize looks up AuthorizeData by a code and deletes it in a single conditional operation.
+// Only one of concurrent callers gets the AuthorizeData, others get ErrAuthorizeNotFound.
+// Can return error if expired, the code is deleted anyway.
+// This is not a part of interface, see StorageConfig.ConsumeAuthorizeOnLoad to use it in osin flow.
+func (receiver *Storage) ConsumeAuthorize(code string) (*osin.AuthorizeData, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.ConsumeAuthorizeWithContext(ctx, code)
+}
+
+// ConsumeAuthorizeWithContext is the same as ConsumeAuthorize with the ability to pass a context.
+func (receiver *Storage) ConsumeAuthorizeWithContext(ctx context.Context, code string) (*osin.AuthorizeData, error) {
+	params := &dynamodb.DeleteItemInput{
+		Key:                 receiver.itemKey(authorizeEntity, receiver.tokenKey(code)),
+		ConditionExpression: aws.String("attribute_exists(code)"),
+		ReturnValues:        aws.String(dynamodb.ReturnValueAllOld),
+		TableName:           receiver.tableName(authorizeEntity),
+	}
+
+	resp, err := receiver.db.DeleteItemWithContext(ctx, params)
+	if isConditionalCheckFailed(err) {
+		return nil, ErrAuthorizeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return receiver.decodeAuthorize(resp.Attributes, code)
+}
+
+// decodeAuthorize converts authorize table item to AuthorizeData, ErrTokenExpired is returned if it expired
+func (receiver *Storage) decodeAuthorize(item map[string]*dynamodb.AttributeValue, code string) (*osin.AuthorizeData, error) {
+	authorizeData, err := receiver.authorizeFromItem(item, code)
 	if err != nil {
 		return nil, err
 	}
@@ -363,18 +801,47 @@ func (receiver *Storage) LoadAuthorize(code string) (authorizeData *osin.Authori
 	return authorizeData, nil
 }
 
+// authorizeFromItem converts authorize table item to AuthorizeData regardless of its expiration
+func (receiver *Storage) authorizeFromItem(item map[string]*dynamodb.AttributeValue, code string) (*osin.AuthorizeData, error) {
+	var authorizeData *osin.AuthorizeData
+	if _, ok := item["json"]; ok {
+		authorizeData = &osin.AuthorizeData{}
+		authorizeData.Client = receiver.newClient()
+		data, err := receiver.decodePayload(item["json"], itemPayloadContext(authorizeEntity, item, "json"))
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &authorizeData)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if authorizeData, err = receiver.authorizeFromAttributes(item); err != nil {
+			return nil, err
+		}
+	}
+	// raw code isn't persisted if HashTokens is enabled
+	authorizeData.Code = code
+
+	return authorizeData, nil
+}
+
 // RemoveAuthorize revokes or deletes the authorization code.
 func (receiver *Storage) RemoveAuthorize(code string) error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.RemoveAuthorizeWithContext(ctx, code)
+}
+
+// RemoveAuthorizeWithContext is the same as RemoveAuthorize with the ability to pass a context.
+func (receiver *Storage) RemoveAuthorizeWithContext(ctx context.Context, code string) error {
 	params := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"code": {
-				S: aws.String(code),
-			},
-		},
-		TableName: aws.String(receiver.config.AuthorizeTable),
+		Key:       receiver.itemKey(authorizeEntity, receiver.removeTokenKey(code)),
+		TableName: receiver.tableName(authorizeEntity),
 	}
 
-	if _, err := receiver.db.DeleteItem(params); err != nil {
+	if _, err := receiver.db.DeleteItemWithContext(ctx, params); err != nil {
 		return err
 	}
 
@@ -382,60 +849,156 @@ func (receiver *Storage) RemoveAuthorize(code string) error {
 }
 
 // SaveAccess writes AccessData.
+// If AccessData has refresh token, both access and refresh tokens are written in a single transaction.
 func (receiver *Storage) SaveAccess(accessData *osin.AccessData) error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.SaveAccessWithContext(ctx, accessData)
+}
+
+// SaveAccessWithContext is the same as SaveAccess with the ability to pass a context.
+func (receiver *Storage) SaveAccessWithContext(ctx context.Context, accessData *osin.AccessData) error {
 	// @issue https://github.com/RangelReale/osin/issues/47
 	if accessData.AccessData != nil && accessData.AccessData.AccessData != nil {
 		accessData.AccessData.AccessData = nil
 	}
 
-	data, err := json.Marshal(accessData)
+	if accessData.RefreshToken == "" {
+		items, err := receiver.accessItem(accessData, "")
+		if err != nil {
+			return err
+		}
+
+		params := &dynamodb.PutItemInput{
+			Item:                     items,
+			ConditionExpression:      receiver.notExistsCondition(),
+			ExpressionAttributeNames: receiver.notExistsNames("token"),
+			TableName:                receiver.tableName(accessEntity),
+		}
+
+		_, err = receiver.db.PutItemWithContext(ctx, params)
+		if isConditionalCheckFailed(err) {
+			return ErrTokenExists
+		}
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	grant, err := receiver.refreshGrantOf(ctx, accessData)
 	if err != nil {
 		return err
 	}
-	items := map[string]*dynamodb.AttributeValue{
-		"token": {
-			S: aws.String(accessData.AccessToken),
-		},
-		"json": {
-			S: aws.String(string(data)),
+	items, err := receiver.accessItem(accessData, grant.family)
+	if err != nil {
+		return err
+	}
+	refreshItems, err := receiver.refreshItem(accessData, grant)
+	if err != nil {
+		return err
+	}
+	params := &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Put: &dynamodb.Put{
+					Item:                     items,
+					ConditionExpression:      receiver.notExistsCondition(),
+					ExpressionAttributeNames: receiver.notExistsNames("token"),
+					TableName:                receiver.tableName(accessEntity),
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					Item:                     refreshItems,
+					ConditionExpression:      receiver.notExistsCondition(),
+					ExpressionAttributeNames: receiver.notExistsNames("token"),
+					TableName:                receiver.tableName(refreshEntity),
+				},
+			},
 		},
 	}
 
-	if userData, ok := accessData.UserData.(UserData); ok {
-		for k, v := range userData.ToAttributeValues() {
-			items[k] = v
+	// previous refresh token is rotated or removed together with saving the new one
+	previous := accessData.AccessData
+	rotating := previous != nil && previous.RefreshToken != "" && previous.RefreshToken != accessData.RefreshToken
+	if rotating && receiver.config.RefreshTokenRotation {
+		params.TransactItems = append(params.TransactItems, receiver.rotatedRefreshUpdate(previous.RefreshToken, time.Now()))
+	} else if rotating && receiver.config.RemovePreviousRefreshOnSave {
+		params.TransactItems = append(params.TransactItems, &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				Key:       receiver.itemKey(refreshEntity, receiver.removeTokenKey(previous.RefreshToken)),
+				TableName: receiver.tableName(refreshEntity),
+			},
+		})
+	}
+
+	_, err = receiver.db.TransactWriteItemsWithContext(ctx, params)
+	failed := failedTransactionItems(err)
+	if rotating && receiver.config.RefreshTokenRotation && failed[2] {
+		if err := receiver.revokeRefreshFamily(ctx, grant.family); err != nil {
+			return err
 		}
+		return ErrRefreshTokenReused
 	}
-	params := &dynamodb.PutItemInput{
-		Item:      items,
-		TableName: aws.String(receiver.config.AccessTable),
+	if len(failed) > 0 {
+		return ErrTokenExists
 	}
-
-	if _, err := receiver.db.PutItem(params); err != nil {
+	if err != nil {
 		return err
 	}
 
-	if accessData.RefreshToken != "" {
-		return receiver.SaveRefresh(accessData)
+	return nil
+}
+
+// accessItem converts AccessData to access table item
+func (receiver *Storage) accessItem(accessData *osin.AccessData, family string) (map[string]*dynamodb.AttributeValue, error) {
+	items := map[string]*dynamodb.AttributeValue{
+		"token": {
+			S: aws.String(receiver.tokenKey(accessData.AccessToken)),
+		},
+		receiver.ttlAttribute(): epochValue(accessData.ExpireAt()),
+	}
+	if err := receiver.encodeAccess(items, accessEntity, accessData); err != nil {
+		return nil, err
+	}
+	if family != "" {
+		items["family"] = &dynamodb.AttributeValue{
+			S: aws.String(family),
+		}
 	}
+	setClientID(items, accessData.Client)
+	receiver.setItemKey(items, accessEntity)
 
-	return nil
+	if userData, ok := accessData.UserData.(UserData); ok {
+		for k, v := range userData.ToAttributeValues() {
+			items[k] = v
+		}
+	}
+
+	return items, nil
 }
 
 // LoadAccess retrieves access data by token. Client information is loaded together.
 // Can return error if expired.
 func (receiver *Storage) LoadAccess(token string) (accessData *osin.AccessData, err error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.LoadAccessWithContext(ctx, token)
+}
+
+// LoadAccessWithContext is the same as LoadAccess with the ability to pass a context.
+func (receiver *Storage) LoadAccessWithContext(ctx context.Context, token string) (accessData *osin.AccessData, err error) {
+	projection, names := receiver.accessProjection()
 	params := &dynamodb.GetItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"token": {
-				S: aws.String(token),
-			},
-		},
-		ProjectionExpression: aws.String("json"),
-		TableName:            aws.String(receiver.config.AccessTable),
+		Key:                      receiver.itemKey(accessEntity, receiver.tokenKey(token)),
+		ProjectionExpression:     projection,
+		ExpressionAttributeNames: names,
+		TableName:                receiver.tableName(accessEntity),
 	}
 
-	resp, err := receiver.db.GetItem(params)
+	resp, err := receiver.db.GetItemWithContext(ctx, params)
 	if err != nil {
 		return nil, err
 	}
@@ -444,43 +1007,97 @@ func (receiver *Storage) LoadAccess(token string) (accessData *osin.AccessData,
 		return nil, ErrAccessNotFound
 	}
 
-	accessData = &osin.AccessData{}
-	accessData.Client = &osin.DefaultClient{}
-	accessData.AccessData = &osin.AccessData{
-		Client: &osin.DefaultClient{},
-		AuthorizeData: &osin.AuthorizeData{
-			Client: &osin.DefaultClient{},
-		},
-	}
-	accessData.AuthorizeData = &osin.AuthorizeData{
-		Client: &osin.DefaultClient{},
-	}
-	if receiver.config.CreateUserData != nil {
-		accessData.UserData = receiver.config.CreateUserData()
-	}
-	data := resp.Item["json"].S
-	err = json.Unmarshal([]byte(*data), &accessData)
+	accessData, err = receiver.decodeAccess(resp.Item, accessEntity)
 	if err != nil {
 		return nil, err
 	}
+	// raw token isn't persisted if HashTokens is enabled
+	accessData.AccessToken = token
 	if accessData.ExpireAt().Before(time.Now()) {
 		return nil, ErrTokenExpired
 	}
 	return accessData, nil
 }
 
+// decodeAccess converts item of e, access or refresh table item, to AccessData
+func (receiver *Storage) decodeAccess(item map[string]*dynamodb.AttributeValue, e entity) (*osin.AccessData, error) {
+	var userData interface{}
+	var userDataDecoder UserDataDecoder
+	if receiver.config.CreateUserData != nil {
+		userData = receiver.config.CreateUserData()
+		userDataDecoder, _ = userData.(UserDataDecoder)
+	}
+	if userDataDecoder != nil {
+		// user data is read from attributes, don't unmarshal json into it
+		userData = nil
+	}
+
+	var accessData *osin.AccessData
+	if _, ok := item["json"]; ok {
+		accessData = &osin.AccessData{}
+		accessData.Client = receiver.newClient()
+		accessData.AccessData = &osin.AccessData{
+			Client: receiver.newClient(),
+			AuthorizeData: &osin.AuthorizeData{
+				Client: receiver.newClient(),
+			},
+		}
+		accessData.AuthorizeData = &osin.AuthorizeData{
+			Client: receiver.newClient(),
+		}
+		accessData.UserData = userData
+		data, err := receiver.decodePayload(item["json"], itemPayloadContext(e, item, "json"))
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &accessData)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if accessData, err = receiver.accessFromAttributes(item, userData); err != nil {
+			return nil, err
+		}
+	}
+	if userDataDecoder != nil {
+		if err := userDataDecoder.FromAttributeValues(item); err != nil {
+			return nil, err
+		}
+		accessData.UserData = userDataDecoder
+	}
+	return accessData, nil
+}
+
+// accessProjection returns projection expression of access and refresh table items together with extra attributes
+// and its expression attribute names. Both encodings are projected, so items written with either of them can be decoded.
+// All attributes are loaded if user data is read from attributes.
+func (receiver *Storage) accessProjection(extra ...string) (*string, map[string]*string) {
+	if receiver.config.CreateUserData != nil {
+		if _, ok := receiver.config.CreateUserData().(UserDataDecoder); ok {
+			return nil, nil
+		}
+	}
+	attributes := make([]string, 0, len(accessAttributeNames)+len(extra))
+	attributes = append(attributes, accessAttributeNames...)
+	return projection(append(attributes, extra...)...)
+}
+
 // RemoveAccess revokes or deletes an AccessData.
 func (receiver *Storage) RemoveAccess(token string) error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.RemoveAccessWithContext(ctx, token)
+}
+
+// RemoveAccessWithContext is the same as RemoveAccess with the ability to pass a context.
+func (receiver *Storage) RemoveAccessWithContext(ctx context.Context, token string) error {
 	params := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"token": {
-				S: aws.String(token),
-			},
-		},
-		TableName: aws.String(receiver.config.AccessTable),
+		Key:       receiver.itemKey(accessEntity, receiver.removeTokenKey(token)),
+		TableName: receiver.tableName(accessEntity),
 	}
 
-	if _, err := receiver.db.DeleteItem(params); err != nil {
+	if _, err := receiver.db.DeleteItemWithContext(ctx, params); err != nil {
 		return err
 	}
 
@@ -489,58 +1106,159 @@ func (receiver *Storage) RemoveAccess(token string) error {
 
 // SaveRefresh writes AccessData for refresh token
 // This method is not a part of interface and as so, it's never used in osin flow.
-// This method is used internally by SaveAccess(accessData *osin.AccessData)
-// and can be useful for testing
+// SaveAccess(accessData *osin.AccessData) writes refresh token together with access token,
+// so this method can be useful mostly for testing
 func (receiver *Storage) SaveRefresh(accessData *osin.AccessData) error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.SaveRefreshWithContext(ctx, accessData)
+}
+
+// SaveRefreshWithContext is the same as SaveRefresh with the ability to pass a context.
+func (receiver *Storage) SaveRefreshWithContext(ctx context.Context, accessData *osin.AccessData) error {
 	// @issue https://github.com/RangelReale/osin/issues/47
 	if accessData.AccessData != nil && accessData.AccessData.AccessData != nil {
 		accessData.AccessData.AccessData = nil
 	}
 
-	data, err := json.Marshal(accessData)
+	grant, err := receiver.refreshGrantOf(ctx, accessData)
+	if err != nil {
+		return err
+	}
+	items, err := receiver.refreshItem(accessData, grant)
+	if err != nil {
+		return err
+	}
+	params := &dynamodb.PutItemInput{
+		Item:                     items,
+		ConditionExpression:      receiver.notExistsCondition(),
+		ExpressionAttributeNames: receiver.notExistsNames("token"),
+		TableName:                receiver.tableName(refreshEntity),
+	}
+
+	_, err = receiver.db.PutItemWithContext(ctx, params)
+	if isConditionalCheckFailed(err) {
+		return ErrTokenExists
+	}
 	if err != nil {
 		return err
 	}
+
+	return nil
+}
+
+// refreshGrant identifies the grant refresh token belongs to.
+// It's carried from previous refresh token (AccessData.AccessData) to the new one.
+type refreshGrant struct {
+	// family is id of refresh token family, empty if RefreshTokenRotation is disabled
+	family string
+	// grantedAt is when the first refresh token of the grant was created, RefreshTokenLifetime is counted from it
+	grantedAt time.Time
+}
+
+// refreshGrantOf returns grant of refresh token of accessData.
+// Previous refresh token is read only if RefreshTokenRotation or RefreshTokenLifetime is configured.
+func (receiver *Storage) refreshGrantOf(ctx context.Context, accessData *osin.AccessData) (refreshGrant, error) {
+	grant := refreshGrant{
+		grantedAt: accessData.CreatedAt,
+	}
+	tracked := receiver.config.RefreshTokenRotation || receiver.config.RefreshTokenLifetime > 0
+	if previous := accessData.AccessData; tracked && previous != nil && previous.RefreshToken != "" {
+		projection, names := projection("family", "granted_at")
+		params := &dynamodb.GetItemInput{
+			Key:                      receiver.itemKey(refreshEntity, receiver.removeTokenKey(previous.RefreshToken)),
+			ProjectionExpression:     projection,
+			ExpressionAttributeNames: names,
+			TableName:                receiver.tableName(refreshEntity),
+		}
+
+		resp, err := receiver.db.GetItemWithContext(ctx, params)
+		if err != nil {
+			return grant, err
+		}
+		if family, ok := resp.Item["family"]; ok && family.S != nil {
+			grant.family = *family.S
+		}
+		// tokens written before granted_at was tracked started their grant
+		if !previous.CreatedAt.IsZero() {
+			grant.grantedAt = previous.CreatedAt
+		}
+		grantedAt, ok, err := epochAttribute(resp.Item, "granted_at")
+		if err != nil {
+			return grant, err
+		}
+		if ok {
+			grant.grantedAt = grantedAt
+		}
+	}
+
+	if receiver.config.RefreshTokenRotation && grant.family == "" {
+		family, err := newRefreshFamily()
+		if err != nil {
+			return grant, err
+		}
+		grant.family = family
+	}
+
+	return grant, nil
+}
+
+// refreshItem converts AccessData to refresh table item
+func (receiver *Storage) refreshItem(accessData *osin.AccessData, grant refreshGrant) (map[string]*dynamodb.AttributeValue, error) {
 	items := map[string]*dynamodb.AttributeValue{
 		"token": {
-			S: aws.String(accessData.RefreshToken),
-		},
-		"json": {
-			S: aws.String(string(data)),
+			S: aws.String(receiver.tokenKey(accessData.RefreshToken)),
 		},
 	}
+	if err := receiver.encodeAccess(items, refreshEntity, accessData); err != nil {
+		return nil, err
+	}
+	if receiver.config.RefreshTokenIdleLifetime > 0 {
+		items["last_used_at"] = epochValue(accessData.CreatedAt)
+	}
+	if receiver.config.RefreshTokenLifetime > 0 {
+		items["granted_at"] = epochValue(grant.grantedAt)
+	}
+	if expireAt := receiver.refreshExpireAt(grant.grantedAt, accessData.CreatedAt); !expireAt.IsZero() {
+		items[receiver.ttlAttribute()] = epochValue(expireAt)
+	}
+	if grant.family != "" {
+		items["family"] = &dynamodb.AttributeValue{
+			S: aws.String(grant.family),
+		}
+	}
+	setClientID(items, accessData.Client)
+	receiver.setItemKey(items, refreshEntity)
 
 	if userData, ok := accessData.UserData.(UserData); ok {
 		for k, v := range userData.ToAttributeValues() {
 			items[k] = v
 		}
 	}
-	params := &dynamodb.PutItemInput{
-		Item:      items,
-		TableName: aws.String(receiver.config.RefreshTable),
-	}
-
-	if _, err := receiver.db.PutItem(params); err != nil {
-		return err
-	}
 
-	return nil
+	return items, nil
 }
 
 // LoadRefresh retrieves refresh AccessData. Client information is loaded together.
-// Refresh token doesn't expire.
+// Refresh token doesn't expire unless RefreshTokenLifetime or RefreshTokenIdleLifetime is configured,
+// in such case it can return error if expired.
 func (receiver *Storage) LoadRefresh(token string) (accessData *osin.AccessData, err error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.LoadRefreshWithContext(ctx, token)
+}
+
+// LoadRefreshWithContext is the same as LoadRefresh with the ability to pass a context.
+func (receiver *Storage) LoadRefreshWithContext(ctx context.Context, token string) (accessData *osin.AccessData, err error) {
+	projection, names := receiver.accessProjection("last_used_at", "granted_at", "family", "rotated_at")
 	params := &dynamodb.GetItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"token": {
-				S: aws.String(token),
-			},
-		},
-		ProjectionExpression: aws.String("json"),
-		TableName:            aws.String(receiver.config.RefreshTable),
+		Key:                      receiver.itemKey(refreshEntity, receiver.tokenKey(token)),
+		ProjectionExpression:     projection,
+		ExpressionAttributeNames: names,
+		TableName:                receiver.tableName(refreshEntity),
 	}
 
-	resp, err := receiver.db.GetItem(params)
+	resp, err := receiver.db.GetItemWithContext(ctx, params)
 	if err != nil {
 		return nil, err
 	}
@@ -549,40 +1267,112 @@ func (receiver *Storage) LoadRefresh(token string) (accessData *osin.AccessData,
 		return nil, ErrRefreshNotFound
 	}
 
-	accessData = &osin.AccessData{}
-	accessData.Client = &osin.DefaultClient{}
-	accessData.AccessData = &osin.AccessData{
-		Client: &osin.DefaultClient{},
-		AuthorizeData: &osin.AuthorizeData{
-			Client: &osin.DefaultClient{},
-		},
+	// rotated token is never valid again, even if rotation was disabled since
+	if _, rotated := resp.Item["rotated_at"]; rotated {
+		if family, ok := resp.Item["family"]; ok && family.S != nil && receiver.config.RefreshTokenRotation {
+			if err := receiver.revokeRefreshFamily(ctx, *family.S); err != nil {
+				return nil, err
+			}
+		}
+		return nil, ErrRefreshTokenReused
 	}
-	accessData.AuthorizeData = &osin.AuthorizeData{
-		Client: &osin.DefaultClient{},
+
+	accessData, err = receiver.decodeAccess(resp.Item, refreshEntity)
+	if err != nil {
+		return nil, err
 	}
-	if receiver.config.CreateUserData != nil {
-		accessData.UserData = receiver.config.CreateUserData()
+	// raw token isn't persisted if HashTokens is enabled
+	accessData.RefreshToken = token
+
+	lastUsedAt, ok, err := epochAttribute(resp.Item, "last_used_at")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		lastUsedAt = accessData.CreatedAt
 	}
-	data := resp.Item["json"].S
-	err = json.Unmarshal([]byte(*data), &accessData)
+	grantedAt, ok, err := epochAttribute(resp.Item, "granted_at")
 	if err != nil {
 		return nil, err
 	}
+	if !ok {
+		grantedAt = accessData.CreatedAt
+	}
+	now := time.Now()
+	expireAt := receiver.refreshExpireAt(grantedAt, lastUsedAt)
+	if !expireAt.IsZero() && expireAt.Before(now) {
+		return nil, ErrTokenExpired
+	}
+
+	if receiver.config.RefreshTokenIdleLifetime > 0 {
+		if err := receiver.touchRefresh(ctx, token, grantedAt, now); err != nil {
+			return nil, err
+		}
+	}
+
 	return accessData, nil
 }
 
+// touchRefresh updates last_used_at and extends Time To Live of refresh token
+func (receiver *Storage) touchRefresh(ctx context.Context, token string, grantedAt time.Time, now time.Time) error {
+	params := &dynamodb.UpdateItemInput{
+		Key:                 receiver.itemKey(refreshEntity, receiver.tokenKey(token)),
+		ConditionExpression: aws.String("attribute_exists(#token)"),
+		UpdateExpression:    aws.String("SET last_used_at = :now, #ttl = :ttl"),
+		ExpressionAttributeNames: map[string]*string{
+			"#token": aws.String("token"),
+			"#ttl":   aws.String(receiver.ttlAttribute()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": epochValue(now),
+			":ttl": epochValue(receiver.refreshExpireAt(grantedAt, now)),
+		},
+		TableName: receiver.tableName(refreshEntity),
+	}
+
+	_, err := receiver.db.UpdateItemWithContext(ctx, params)
+	if isConditionalCheckFailed(err) {
+		return ErrRefreshNotFound
+	}
+
+	return err
+}
+
+// refreshExpireAt returns expiration time of refresh token or zero time if it doesn't expire
+func (receiver *Storage) refreshExpireAt(grantedAt time.Time, lastUsedAt time.Time) time.Time {
+	var expireAt time.Time
+	if receiver.config.RefreshTokenLifetime > 0 {
+		expireAt = grantedAt.Add(receiver.config.RefreshTokenLifetime)
+	}
+	if receiver.config.RefreshTokenIdleLifetime > 0 {
+		idleExpireAt := lastUsedAt.Add(receiver.config.RefreshTokenIdleLifetime)
+		if expireAt.IsZero() || idleExpireAt.Before(expireAt) {
+			expireAt = idleExpireAt
+		}
+	}
+	return expireAt
+}
+
 // RemoveRefresh revokes or deletes refresh AccessData.
+// If RefreshTokenRotation is enabled, the token is kept as rotated to detect its reuse.
 func (receiver *Storage) RemoveRefresh(token string) error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.RemoveRefreshWithContext(ctx, token)
+}
+
+// RemoveRefreshWithContext is the same as RemoveRefresh with the ability to pass a context.
+func (receiver *Storage) RemoveRefreshWithContext(ctx context.Context, token string) error {
+	if receiver.config.RefreshTokenRotation {
+		return receiver.tombstoneRefresh(ctx, token)
+	}
+
 	params := &dynamodb.DeleteItemInput{
-		TableName: aws.String(receiver.config.RefreshTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"token": {
-				S: aws.String(token),
-			},
-		},
+		TableName: receiver.tableName(refreshEntity),
+		Key:       receiver.itemKey(refreshEntity, receiver.removeTokenKey(token)),
 	}
 
-	_, err := receiver.db.DeleteItem(params)
+	_, err := receiver.db.DeleteItemWithContext(ctx, params)
 	if err != nil {
 		return err
 	}
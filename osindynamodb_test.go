@@ -1,14 +1,21 @@
 package osindynamodb
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/RangelReale/osin"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestSchema(t *testing.T) {
@@ -23,9 +30,1621 @@ func TestSchema(t *testing.T) {
 	assert.Nil(t, err, "%s", err)
 }
 
+func TestEnsureSchema(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("EnsureSchema")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	expected := []SchemaChange{
+		{Table: storageConfig.AccessTable, Action: SchemaActionCreateTable},
+		{Table: storageConfig.AccessTable, Action: SchemaActionEnableTimeToLive, Name: DefaultTTLAttribute},
+		{Table: storageConfig.AuthorizeTable, Action: SchemaActionCreateTable},
+		{Table: storageConfig.AuthorizeTable, Action: SchemaActionEnableTimeToLive, Name: DefaultTTLAttribute},
+		{Table: storageConfig.ClientTable, Action: SchemaActionCreateTable},
+		{Table: storageConfig.RefreshTable, Action: SchemaActionCreateTable},
+		{Table: storageConfig.RefreshTable, Action: SchemaActionEnableTimeToLive, Name: DefaultTTLAttribute},
+	}
+
+	changes, err := storage.EnsureSchema(true)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, expected, changes)
+	_, err = svc.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(storageConfig.ClientTable),
+	})
+	assert.NotNil(t, err)
+
+	changes, err = storage.EnsureSchema(false)
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	assert.Equal(t, expected, changes)
+
+	changes, err = storage.EnsureSchema(false)
+	assert.Nil(t, err, "%s", err)
+	assert.Empty(t, changes)
+
+	// user index is added to existing tables
+	storageConfig.UserIDAttribute = "username"
+	storage = New(svc, storageConfig)
+	changes, err = storage.EnsureSchema(false)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, []SchemaChange{
+		{Table: storageConfig.AccessTable, Action: SchemaActionCreateIndex, Name: UserIndex},
+		{Table: storageConfig.RefreshTable, Action: SchemaActionCreateIndex, Name: UserIndex},
+	}, changes)
+	err = storage.RevokeUserTokens("kamil@uniplaces.com")
+	assert.Nil(t, err, "%s", err)
+}
+
+func TestEnsureSchemaBillingMode(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("EnsureSchemaBillingMode")
+	var err error
+	svc := createDynamoDB()
+	storageConfig.AccessTableOptions = &TableOptions{BillingMode: dynamodb.BillingModePayPerRequest}
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+
+	// index throughput follows billing mode of existing table, not the configured one
+	storageConfig.UserIDAttribute = "username"
+	storageConfig.AccessTableOptions = nil
+	storageConfig.RefreshTableOptions = &TableOptions{BillingMode: dynamodb.BillingModePayPerRequest}
+	storage = New(svc, storageConfig)
+	changes, err := storage.EnsureSchema(false)
+	assert.Nil(t, err, "%s", err)
+	assert.Len(t, changes, 2)
+
+	resp, err := svc.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(storageConfig.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	for _, index := range resp.Table.GlobalSecondaryIndexes {
+		assert.NotNil(t, index.ProvisionedThroughput, "%s", *index.IndexName)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("Verify")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+
+	report, err := storage.Verify()
+	assert.Nil(t, err, "%s", err)
+	assert.True(t, report.OK(), "%v", report.Problems)
+	assert.Len(t, report.Tables, 4)
+
+	// user index is missing (client table definition now names access table, so it expects it as well)
+	// and client table is misconfigured
+	storageConfig.UserIDAttribute = "username"
+	storageConfig.ClientTable = storageConfig.AccessTable
+	storage = New(svc, storageConfig)
+	report, err = storage.Verify()
+	assert.Nil(t, err, "%s", err)
+	assert.False(t, report.OK())
+	kinds := map[SchemaProblemKind]int{}
+	for _, problem := range report.Problems {
+		kinds[problem.Kind]++
+	}
+	assert.Equal(t, map[SchemaProblemKind]int{
+		SchemaProblemKeySchema:    1,
+		SchemaProblemMissingIndex: 3,
+	}, kinds)
+
+	storageConfig.ClientTable = "VerifyMissing"
+	storage = New(svc, storageConfig)
+	report, err = storage.Verify()
+	assert.Nil(t, err, "%s", err)
+	assert.Contains(t, report.Problems, SchemaProblem{
+		Table:   "VerifyMissing",
+		Kind:    SchemaProblemMissingTable,
+		Message: "table VerifyMissing doesn't exist",
+	})
+}
+
+func TestTableOptions(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("TableOptions")
+	storageConfig.TableOptions = TableOptions{
+		ReadCapacityUnits:  5,
+		WriteCapacityUnits: 2,
+		Tags: map[string]string{
+			"service": "oauth",
+		},
+	}
+	storageConfig.AccessTableOptions = &TableOptions{
+		BillingMode: dynamodb.BillingModePayPerRequest,
+	}
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+
+	resp, err := svc.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(storageConfig.AccessTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, dynamodb.BillingModePayPerRequest, aws.StringValue(resp.Table.BillingModeSummary.BillingMode))
+
+	resp, err = svc.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(storageConfig.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, int64(5), aws.Int64Value(resp.Table.ProvisionedThroughput.ReadCapacityUnits))
+	assert.Equal(t, int64(2), aws.Int64Value(resp.Table.ProvisionedThroughput.WriteCapacityUnits))
+	for _, index := range resp.Table.GlobalSecondaryIndexes {
+		assert.Equal(t, int64(5), aws.Int64Value(index.ProvisionedThroughput.ReadCapacityUnits))
+	}
+
+	params := &dynamodb.CreateTableInput{}
+	applyTableOptions(params, TableOptions{
+		SSE:            true,
+		KMSMasterKeyID: "alias/oauth",
+		StreamViewType: dynamodb.StreamViewTypeNewAndOldImages,
+		Tags:           storageConfig.TableOptions.Tags,
+	})
+	assert.Equal(t, "alias/oauth", aws.StringValue(params.SSESpecification.KMSMasterKeyId))
+	assert.Equal(t, dynamodb.StreamViewTypeNewAndOldImages, aws.StringValue(params.StreamSpecification.StreamViewType))
+	assert.Equal(t, []*dynamodb.Tag{{Key: aws.String("service"), Value: aws.String("oauth")}}, params.Tags)
+}
+
 func TestClient(t *testing.T) {
 	t.Parallel()
-	storageConfig := CreateStorageConfig("Client")
+	storageConfig := CreateStorageConfig("Client")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+
+	got, err := storage.GetClient(client.Id)
+	assert.Equal(t, ErrClientNotFound, err)
+	assert.Nil(t, got)
+
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
+
+	got, err = storage.GetClient(client.Id)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, client, got)
+
+	err = storage.RemoveClient(client.Id)
+	assert.Nil(t, err, "%s", err)
+
+	got, err = storage.GetClient(client.Id)
+	assert.Equal(t, ErrClientNotFound, err)
+	assert.Nil(t, got)
+}
+
+func TestListClients(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("ListClients")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	for i := 0; i < 5; i++ {
+		err = storage.CreateClient(&osin.DefaultClient{
+			Id:          strconv.Itoa(i),
+			Secret:      "aabbccdd",
+			RedirectUri: "/dev/null/" + strconv.Itoa(i%2),
+		})
+		assert.Nil(t, err, "%s", err)
+	}
+
+	ids := map[string]bool{}
+	pageToken := ""
+	for pages := 0; pages == 0 || pageToken != ""; pages++ {
+		var clients []osin.Client
+		clients, pageToken, err = storage.ListClients(pageToken, 2)
+		assert.Nil(t, err, "%s", err)
+		assert.True(t, len(clients) <= 2)
+		for _, client := range clients {
+			ids[client.GetId()] = true
+		}
+		if pages > 5 {
+			t.Fatal("Too many pages")
+		}
+	}
+	assert.Len(t, ids, 5)
+
+	clients, pageToken, err := storage.ListClients("", 0, func(client osin.Client) bool {
+		return client.GetRedirectUri() == "/dev/null/0"
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Empty(t, pageToken)
+	assert.Len(t, clients, 3)
+
+	_, _, err = storage.ListClients("invalid", 2)
+	assert.Equal(t, ErrInvalidPageToken, err)
+}
+
+func TestCustomClient(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("CustomClient")
+	storageConfig.CreateClient = func() osin.Client {
+		return &ClientTest{}
+	}
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &ClientTest{
+		DefaultClient: osin.DefaultClient{
+			Id:     "1234",
+			Secret: "aabbccdd",
+		},
+		Scopes: []string{"read", "write"},
+	}
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
+
+	got, err := storage.GetClient(client.Id)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, client, got)
+
+	accessData := &osin.AccessData{
+		Client:      client,
+		AccessToken: "1",
+		ExpiresIn:   3600,
+		CreatedAt:   time.Now(),
+	}
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
+	gotAccess, err := storage.LoadAccess(accessData.AccessToken)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, client, gotAccess.Client)
+}
+
+func TestUpdateClient(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("UpdateClient")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:          "1234",
+		Secret:      "aabbccdd",
+		RedirectUri: "/dev/null",
+	}
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
+
+	_, version, err := storage.GetClientWithVersion(client.Id)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, int64(1), version)
+
+	redirectURI := "/dev/zero"
+	version, err = storage.UpdateClient(client.Id, version, ClientUpdate{
+		RedirectUri: &redirectURI,
+		UserData:    map[string]interface{}{"name": "test"},
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, int64(2), version)
+
+	got, err := storage.GetClient(client.Id)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, redirectURI, got.GetRedirectUri())
+	assert.Equal(t, client.Secret, got.GetSecret())
+	assert.Equal(t, map[string]interface{}{"name": "test"}, got.GetUserData())
+
+	// stale version
+	secret := "eeff"
+	_, err = storage.UpdateClient(client.Id, 1, ClientUpdate{
+		Secret: &secret,
+	})
+	assert.Equal(t, ErrVersionConflict, err)
+
+	_, err = storage.UpdateClient("unknown", 1, ClientUpdate{
+		Secret: &secret,
+	})
+	assert.Equal(t, ErrClientNotFound, err)
+
+	_, err = storage.UpdateClient(client.Id, version, ClientUpdate{
+		Secret: &secret,
+	})
+	assert.Nil(t, err, "%s", err)
+	got, err = storage.GetClient(client.Id)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, secret, got.GetSecret())
+	assert.Equal(t, redirectURI, got.GetRedirectUri())
+}
+
+func TestUpdateClientAttributesEncoding(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("UpdateClientAttributesEncoding")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	// client written with json encoding before migration
+	legacy := &osin.DefaultClient{
+		Id:          "1234",
+		Secret:      "aabbccdd",
+		RedirectUri: "/dev/null",
+	}
+	err = storage.CreateClient(legacy)
+	assert.Nil(t, err, "%s", err)
+
+	storageConfig.Encoding = AttributesEncoding
+	storage = New(svc, storageConfig)
+	client := &osin.DefaultClient{
+		Id:          "5678",
+		Secret:      "aabbccdd",
+		RedirectUri: "/dev/null",
+	}
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
+
+	redirectURI := "/dev/zero"
+	secret := "eeff"
+	for _, id := range []string{legacy.Id, client.Id} {
+		_, err = storage.UpdateClient(id, 1, ClientUpdate{
+			Secret:      &secret,
+			RedirectUri: &redirectURI,
+			UserData:    map[string]interface{}{"name": "test"},
+		})
+		assert.Nil(t, err, "%s", err)
+		got, err := storage.GetClient(id)
+		assert.Nil(t, err, "%s", err)
+		assert.Equal(t, secret, got.GetSecret())
+		assert.Equal(t, redirectURI, got.GetRedirectUri())
+		assert.Equal(t, map[string]interface{}{"name": "test"}, got.GetUserData())
+	}
+
+	// fields of client attribute are updated in place
+	resp, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(client.Id)},
+		},
+		TableName: aws.String(storageConfig.ClientTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Nil(t, resp.Item["redirect_uri"])
+	assert.Nil(t, resp.Item["secret"])
+	assert.Nil(t, resp.Item["user_data"])
+	assert.Equal(t, redirectURI, aws.StringValue(resp.Item["client"].M["RedirectUri"].S))
+	assert.Equal(t, secret, aws.StringValue(resp.Item["client"].M["Secret"].S))
+
+	_, err = storage.UpdateClient(client.Id, 1, ClientUpdate{
+		Secret: &secret,
+	})
+	assert.Equal(t, ErrVersionConflict, err)
+}
+
+func TestUpdateClientHashedSecret(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("UpdateClientHashedSecret")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	// clients written with plaintext secrets before HashClientSecrets was enabled
+	clients := []*osin.DefaultClient{
+		{Id: "1234", Secret: "aabbccdd", RedirectUri: "/dev/null"},
+		{Id: "5678", Secret: "aabbccdd", RedirectUri: "/dev/null"},
+	}
+	for _, client := range clients {
+		err = storage.CreateClient(client)
+		assert.Nil(t, err, "%s", err)
+	}
+
+	storageConfig.HashClientSecrets = true
+	storageConfig.ClientSecretCost = bcrypt.MinCost
+	storage = New(svc, storageConfig)
+	secret := "eeff"
+	_, err = storage.UpdateClient(clients[0].Id, 1, ClientUpdate{
+		Secret: &secret,
+	})
+	assert.Nil(t, err, "%s", err)
+	got, err := storage.GetClient(clients[0].Id)
+	assert.Nil(t, err, "%s", err)
+	assert.Empty(t, got.GetSecret())
+	assert.Equal(t, clients[0].RedirectUri, got.GetRedirectUri())
+	assert.True(t, got.(osin.ClientSecretMatcher).ClientSecretMatches(secret))
+	resp, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(clients[0].Id)},
+		},
+		TableName: aws.String(storageConfig.ClientTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.NotContains(t, aws.StringValue(resp.Item["json"].S), clients[0].Secret)
+
+	// plaintext secret is never returned next to secret hash, so it isn't copied to tokens
+	_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(clients[1].Id)},
+		},
+		UpdateExpression: aws.String("SET secret_hash = :hash"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":hash": {S: resp.Item["secret_hash"].S},
+		},
+		TableName: aws.String(storageConfig.ClientTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	got, err = storage.GetClient(clients[1].Id)
+	assert.Nil(t, err, "%s", err)
+	assert.Empty(t, got.GetSecret())
+	data, err := json.Marshal(got)
+	assert.Nil(t, err, "%s", err)
+	assert.NotContains(t, string(data), clients[1].Secret)
+}
+
+func TestClientHashedSecret(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("ClientHashedSecret")
+	storageConfig.HashClientSecrets = true
+	storageConfig.ClientSecretCost = bcrypt.MinCost
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
+
+	got, err := storage.GetClient(client.Id)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, client.Id, got.GetId())
+	assert.Empty(t, got.GetSecret())
+	matcher, ok := got.(osin.ClientSecretMatcher)
+	assert.True(t, ok)
+	assert.True(t, matcher.ClientSecretMatches(client.Secret))
+	assert.False(t, matcher.ClientSecretMatches("wrong"))
+
+	// secret hash of other type written by other tools
+	_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(client.Id)},
+		},
+		UpdateExpression: aws.String("SET secret_hash = :hash"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":hash": {N: aws.String("1")},
+		},
+		TableName: aws.String(storageConfig.ClientTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	_, err = storage.GetClient(client.Id)
+	assert.Equal(t, errInvalidSecretHash, err)
+}
+
+func TestRevokeClientTokens(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("RevokeClientTokens")
+	storageConfig.CascadeRemoveClient = true
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	other := &osin.DefaultClient{
+		Id:     "5678",
+		Secret: "aabbccdd",
+	}
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
+	for i := 0; i < 30; i++ {
+		err = storage.SaveAccess(&osin.AccessData{
+			Client:       client,
+			AccessToken:  "a" + strconv.Itoa(i),
+			RefreshToken: "r" + strconv.Itoa(i),
+			ExpiresIn:    3600,
+			CreatedAt:    time.Now(),
+		})
+		assert.Nil(t, err, "%s", err)
+	}
+	authorizeData := &osin.AuthorizeData{
+		Client:      client,
+		Code:        "9999",
+		ExpiresIn:   3600,
+		RedirectUri: "/dev/null",
+		CreatedAt:   time.Now(),
+	}
+	err = storage.SaveAuthorize(authorizeData)
+	assert.Nil(t, err, "%s", err)
+	otherAccess := &osin.AccessData{
+		Client:      other,
+		AccessToken: "other",
+		ExpiresIn:   3600,
+		CreatedAt:   time.Now(),
+	}
+	err = storage.SaveAccess(otherAccess)
+	assert.Nil(t, err, "%s", err)
+
+	err = storage.RemoveClient(client.Id)
+	assert.Nil(t, err, "%s", err)
+
+	for i := 0; i < 30; i++ {
+		_, err = storage.LoadAccess("a" + strconv.Itoa(i))
+		assert.Equal(t, ErrAccessNotFound, err)
+		_, err = storage.LoadRefresh("r" + strconv.Itoa(i))
+		assert.Equal(t, ErrRefreshNotFound, err)
+	}
+	_, err = storage.LoadAuthorize(authorizeData.Code)
+	assert.Equal(t, ErrAuthorizeNotFound, err)
+	_, err = storage.LoadAccess(otherAccess.AccessToken)
+	assert.Nil(t, err, "%s", err)
+}
+
+func TestBackfillClientIDs(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("BackfillClientIDs")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	accessData := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r1",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
+	authorizeData := &osin.AuthorizeData{
+		Client:      client,
+		Code:        "9999",
+		ExpiresIn:   3600,
+		RedirectUri: "/dev/null",
+		CreatedAt:   time.Now(),
+	}
+	err = storage.SaveAuthorize(authorizeData)
+	assert.Nil(t, err, "%s", err)
+
+	// items written before client_id was introduced
+	for _, item := range []struct {
+		table string
+		key   string
+		value string
+	}{
+		{storageConfig.AuthorizeTable, "code", authorizeData.Code},
+		{storageConfig.AccessTable, "token", accessData.AccessToken},
+		{storageConfig.RefreshTable, "token", accessData.RefreshToken},
+	} {
+		_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				item.key: {S: aws.String(item.value)},
+			},
+			UpdateExpression: aws.String("REMOVE client_id"),
+			TableName:        aws.String(item.table),
+		})
+		assert.Nil(t, err, "%s", err)
+	}
+	err = storage.RevokeClientTokens(client.Id)
+	assert.Nil(t, err, "%s", err)
+	_, err = storage.LoadAccess(accessData.AccessToken)
+	assert.Nil(t, err, "%s", err)
+
+	updated, err := storage.BackfillClientIDs()
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, 3, updated)
+	updated, err = storage.BackfillClientIDs()
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, 0, updated)
+
+	err = storage.RevokeClientTokens(client.Id)
+	assert.Nil(t, err, "%s", err)
+	_, err = storage.LoadAccess(accessData.AccessToken)
+	assert.Equal(t, ErrAccessNotFound, err)
+	_, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Equal(t, ErrRefreshNotFound, err)
+	_, err = storage.LoadAuthorize(authorizeData.Code)
+	assert.Equal(t, ErrAuthorizeNotFound, err)
+}
+
+// unprocessedDynamoDB returns all items of BatchWriteItem as unprocessed, as a throttled table does
+type unprocessedDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+}
+
+func (receiver unprocessedDynamoDB) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, options ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	return &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: input.RequestItems,
+	}, nil
+}
+
+func TestRevokeClientTokensUnprocessed(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("RevokeClientTokensUnprocessed")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	err = storage.SaveAccess(&osin.AccessData{
+		Client:      &osin.DefaultClient{Id: "1234"},
+		AccessToken: "1",
+		ExpiresIn:   3600,
+		CreatedAt:   time.Now(),
+	})
+	assert.Nil(t, err, "%s", err)
+
+	// retries are given up instead of waiting forever
+	storage = New(unprocessedDynamoDB{svc}, storageConfig)
+	err = storage.RevokeClientTokens("1234")
+	assert.Equal(t, ErrUnprocessedItems, err)
+}
+
+func TestRevokeUserTokens(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("RevokeUserTokens")
+	storageConfig.UserIDAttribute = "username"
+	storageConfig.CreateUserData = func() interface{} {
+		return &UserDataTest{}
+	}
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	clients := []*osin.DefaultClient{
+		{Id: "1234", Secret: "aabbccdd"},
+		{Id: "5678", Secret: "aabbccdd"},
+	}
+	for i, client := range clients {
+		err = storage.SaveAccess(&osin.AccessData{
+			Client:       client,
+			AccessToken:  "a" + strconv.Itoa(i),
+			RefreshToken: "r" + strconv.Itoa(i),
+			ExpiresIn:    3600,
+			CreatedAt:    time.Now(),
+			UserData:     &UserDataTest{Username: "kamil@uniplaces.com"},
+		})
+		assert.Nil(t, err, "%s", err)
+	}
+	otherAccess := &osin.AccessData{
+		Client:      clients[0],
+		AccessToken: "other",
+		ExpiresIn:   3600,
+		CreatedAt:   time.Now(),
+		UserData:    &UserDataTest{Username: "other@uniplaces.com"},
+	}
+	err = storage.SaveAccess(otherAccess)
+	assert.Nil(t, err, "%s", err)
+
+	grants, err := storage.ListUserGrants("kamil@uniplaces.com")
+	assert.Nil(t, err, "%s", err)
+	assert.Len(t, grants, 4)
+	for _, grant := range grants {
+		assert.Equal(t, "kamil@uniplaces.com", grant.AccessData.UserData.(*UserDataTest).Username)
+	}
+
+	err = storage.RevokeUserTokens("kamil@uniplaces.com")
+	assert.Nil(t, err, "%s", err)
+
+	grants, err = storage.ListUserGrants("kamil@uniplaces.com")
+	assert.Nil(t, err, "%s", err)
+	assert.Empty(t, grants)
+	for i := range clients {
+		_, err = storage.LoadAccess("a" + strconv.Itoa(i))
+		assert.Equal(t, ErrAccessNotFound, err)
+		_, err = storage.LoadRefresh("r" + strconv.Itoa(i))
+		assert.Equal(t, ErrRefreshNotFound, err)
+	}
+	_, err = storage.LoadAccess(otherAccess.AccessToken)
+	assert.Nil(t, err, "%s", err)
+}
+
+func TestUserDataDecoder(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("UserDataDecoder")
+	storageConfig.CreateUserData = func() interface{} {
+		return &DecodedUserDataTest{}
+	}
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	accessData := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r1",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+		UserData:     &DecodedUserDataTest{Username: "kamil@uniplaces.com"},
+	}
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
+
+	// other service changes the attribute
+	_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"token": {S: aws.String(accessData.AccessToken)},
+		},
+		UpdateExpression: aws.String("SET username = :u"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":u": {S: aws.String("changed@uniplaces.com")},
+		},
+		TableName: aws.String(storageConfig.AccessTable),
+	})
+	assert.Nil(t, err, "%s", err)
+
+	got, err := storage.LoadAccess(accessData.AccessToken)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, &DecodedUserDataTest{Username: "changed@uniplaces.com"}, got.UserData)
+
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, &DecodedUserDataTest{Username: "kamil@uniplaces.com"}, got.UserData)
+}
+
+func TestContext(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("Context")
+	storageConfig.DefaultTimeout = 10 * time.Second
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	got, err := storage.GetClientWithContext(ctx, "1234")
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrClientNotFound, err)
+	assert.Nil(t, got)
+
+	got, err = storage.GetClientWithContext(context.Background(), "1234")
+	assert.Equal(t, ErrClientNotFound, err)
+	assert.Nil(t, got)
+}
+
+func TestAccess(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("Access")
+	storageConfig.CreateUserData = func() interface{} {
+		return &UserDataTest{}
+	}
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
+	accessData := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r9999",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+		UserData: &UserDataTest{
+			Username: "kamil@uniplaces.com",
+		},
+	}
+
+	// When AccessToken is saved, RefreshToken should be saved too, so we check for both
+	got, err := storage.LoadAccess(accessData.AccessToken)
+	assert.Equal(t, ErrAccessNotFound, err)
+	assert.Nil(t, got)
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Equal(t, ErrRefreshNotFound, err)
+	assert.Nil(t, got)
+
+	// We only SaveAccess data
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
+
+	got, err = storage.LoadAccess(accessData.AccessToken)
+	// We need to convert it to json as pointers inside structs are different
+	// and assert library doesn't provide recursive value comparison for structs
+	assert.Nil(t, err, "%s", err)
+	gotJSON, err := json.Marshal(got)
+	assert.Nil(t, err, "%s", err)
+	expectedJSON, err := json.Marshal(accessData)
+	assert.Nil(t, err, "%s", err)
+	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	// We need to convert it to json as pointers inside structs are different
+	// and assert library doesn't provide recursive value comparison for structs
+	assert.Nil(t, err, "%s", err)
+	gotJSON, err = json.Marshal(got)
+	assert.Nil(t, err, "%s", err)
+	expectedJSON, err = json.Marshal(accessData)
+	assert.Nil(t, err, "%s", err)
+	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+
+	err = storage.RemoveAccess(accessData.AccessToken)
+	assert.Nil(t, err, "%s", err)
+
+	got, err = storage.LoadAccess(accessData.AccessToken)
+	assert.Equal(t, ErrAccessNotFound, err)
+	assert.Nil(t, got)
+	// RefreshToken should be still there
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	// We need to convert it to json as pointers inside structs are different
+	// and assert library doesn't provide recursive value comparison for structs
+	assert.Nil(t, err, "%s", err)
+	gotJSON, err = json.Marshal(got)
+	assert.Nil(t, err, "%s", err)
+	expectedJSON, err = json.Marshal(accessData)
+	assert.Nil(t, err, "%s", err)
+	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+
+	// let's try with expired token
+	accessData.CreatedAt = accessData.CreatedAt.Add(-time.Duration(accessData.ExpiresIn) * time.Second)
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
+
+	got, err = storage.LoadAccess(accessData.AccessToken)
+	assert.Equal(t, ErrTokenExpired, err)
+	assert.Nil(t, got)
+	// refresh token doesn't expire
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	gotJSON, err = json.Marshal(got)
+	assert.Nil(t, err, "%s", err)
+	expectedJSON, err = json.Marshal(accessData)
+	assert.Nil(t, err, "%s", err)
+	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+}
+
+func TestRefresh(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("Refresh")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
+	accessData := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r9999",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+
+	got, err := storage.LoadRefresh(accessData.RefreshToken)
+	assert.Equal(t, ErrRefreshNotFound, err)
+	assert.Nil(t, got)
+
+	err = storage.SaveRefresh(accessData)
+	assert.Nil(t, err, "%s", err)
+
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	// We need to convert it to json as pointers inside structs are different
+	// and assert library doesn't provide recursive value comparison for structs
+	assert.Nil(t, err, "%s", err)
+	gotJSON, err := json.Marshal(got)
+	assert.Nil(t, err, "%s", err)
+	expectedJSON, err := json.Marshal(accessData)
+	assert.Nil(t, err, "%s", err)
+	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+
+	err = storage.RemoveRefresh(accessData.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Equal(t, ErrRefreshNotFound, err)
+	assert.Nil(t, got)
+
+	// let's try with expired token
+	accessData.CreatedAt = accessData.CreatedAt.Add(-time.Duration(accessData.ExpiresIn) * time.Second)
+	err = storage.SaveRefresh(accessData)
+	assert.Nil(t, err, "%s", err)
+
+	// refresh token doesn't expire
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	gotJSON, err = json.Marshal(got)
+	assert.Nil(t, err, "%s", err)
+	expectedJSON, err = json.Marshal(accessData)
+	assert.Nil(t, err, "%s", err)
+	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+}
+
+func TestRefreshExpiry(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("RefreshExpiry")
+	storageConfig.RefreshTokenLifetime = 2 * time.Hour
+	storageConfig.RefreshTokenIdleLifetime = time.Hour
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	accessData := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r1",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now().Add(-30 * time.Minute),
+	}
+	err = storage.SaveRefresh(accessData)
+	assert.Nil(t, err, "%s", err)
+
+	got, err := storage.LoadRefresh(accessData.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	assert.NotNil(t, got)
+
+	key := map[string]*dynamodb.AttributeValue{
+		"token": {S: aws.String(accessData.RefreshToken)},
+	}
+	resp, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key:       key,
+		TableName: aws.String(storageConfig.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	lastUsedAt, err := strconv.ParseInt(*resp.Item["last_used_at"].N, 10, 64)
+	assert.Nil(t, err, "%s", err)
+	assert.True(t, lastUsedAt > accessData.CreatedAt.Unix())
+
+	// not used for longer than idle lifetime
+	_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key:              key,
+		UpdateExpression: aws.String("SET last_used_at = :t"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":t": {N: aws.String(strconv.FormatInt(time.Now().Add(-61*time.Minute).Unix(), 10))},
+		},
+		TableName: aws.String(storageConfig.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Equal(t, ErrTokenExpired, err)
+	assert.Nil(t, got)
+
+	// older than absolute lifetime
+	accessData.RefreshToken = "r2"
+	accessData.CreatedAt = time.Now().Add(-3 * time.Hour)
+	err = storage.SaveRefresh(accessData)
+	assert.Nil(t, err, "%s", err)
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Equal(t, ErrTokenExpired, err)
+	assert.Nil(t, got)
+
+	// refreshed tokens inherit absolute lifetime of the grant
+	granted := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "3",
+		RefreshToken: "r3",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now().Add(-90 * time.Minute),
+	}
+	err = storage.SaveAccess(granted)
+	assert.Nil(t, err, "%s", err)
+	refreshed := &osin.AccessData{
+		Client:       client,
+		AccessData:   granted,
+		AccessToken:  "4",
+		RefreshToken: "r4",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now().Add(-45 * time.Minute),
+	}
+	err = storage.SaveAccess(refreshed)
+	assert.Nil(t, err, "%s", err)
+	refreshedAgain := &osin.AccessData{
+		Client:       client,
+		AccessData:   refreshed,
+		AccessToken:  "5",
+		RefreshToken: "r5",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(refreshedAgain)
+	assert.Nil(t, err, "%s", err)
+	resp, err = svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"token": {S: aws.String(refreshedAgain.RefreshToken)},
+		},
+		TableName: aws.String(storageConfig.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	expireAt, err := strconv.ParseInt(*resp.Item[DefaultTTLAttribute].N, 10, 64)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, granted.CreatedAt.Add(storageConfig.RefreshTokenLifetime).Unix(), expireAt)
+
+	// grant is older than absolute lifetime
+	_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"token": {S: aws.String(refreshedAgain.RefreshToken)},
+		},
+		UpdateExpression: aws.String("SET granted_at = :t"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":t": {N: aws.String(strconv.FormatInt(time.Now().Add(-3*time.Hour).Unix(), 10))},
+		},
+		TableName: aws.String(storageConfig.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	got, err = storage.LoadRefresh(refreshedAgain.RefreshToken)
+	assert.Equal(t, ErrTokenExpired, err)
+	assert.Nil(t, got)
+}
+
+func TestRefreshRotation(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("RefreshRotation")
+	storageConfig.RemovePreviousRefreshOnSave = true
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	previous := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r1",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(previous)
+	assert.Nil(t, err, "%s", err)
+
+	previous, err = storage.LoadRefresh(previous.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	accessData := &osin.AccessData{
+		Client:       client,
+		AccessData:   previous,
+		AccessToken:  "2",
+		RefreshToken: "r2",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
+
+	_, err = storage.LoadAccess(accessData.AccessToken)
+	assert.Nil(t, err, "%s", err)
+	_, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	_, err = storage.LoadRefresh(previous.RefreshToken)
+	assert.Equal(t, ErrRefreshNotFound, err)
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("RefreshTokenReuse")
+	storageConfig.RefreshTokenRotation = true
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	first := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r1",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(first)
+	assert.Nil(t, err, "%s", err)
+
+	// refresh as osin does it
+	previous, err := storage.LoadRefresh(first.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	second := &osin.AccessData{
+		Client:       client,
+		AccessData:   previous,
+		AccessToken:  "2",
+		RefreshToken: "r2",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(second)
+	assert.Nil(t, err, "%s", err)
+	err = storage.RemoveRefresh(previous.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	err = storage.RemoveAccess(previous.AccessToken)
+	assert.Nil(t, err, "%s", err)
+
+	// rotated token is kept with Time To Live even if refresh tokens don't expire
+	resp, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"token": {S: aws.String(first.RefreshToken)},
+		},
+		TableName: aws.String(storageConfig.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.NotNil(t, resp.Item["rotated_at"])
+	if assert.NotNil(t, resp.Item[DefaultTTLAttribute]) {
+		expireAt, err := strconv.ParseInt(*resp.Item[DefaultTTLAttribute].N, 10, 64)
+		assert.Nil(t, err, "%s", err)
+		assert.True(t, expireAt > time.Now().Add(DefaultRotatedRefreshTokenLifetime-time.Minute).Unix())
+	}
+
+	_, err = storage.LoadRefresh(second.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+
+	// rotated token is replayed, whole family is revoked
+	got, err := storage.LoadRefresh(first.RefreshToken)
+	assert.Equal(t, ErrRefreshTokenReused, err)
+	assert.Nil(t, got)
+	_, err = storage.LoadRefresh(second.RefreshToken)
+	assert.Equal(t, ErrRefreshNotFound, err)
+	_, err = storage.LoadAccess(second.AccessToken)
+	assert.Equal(t, ErrAccessNotFound, err)
+}
+
+func TestRefreshRotationDisabled(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("RefreshRotationDisabled")
+	storageConfig.RefreshTokenRotation = true
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	first := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r1",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(first)
+	assert.Nil(t, err, "%s", err)
+	previous, err := storage.LoadRefresh(first.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	second := &osin.AccessData{
+		Client:       client,
+		AccessData:   previous,
+		AccessToken:  "2",
+		RefreshToken: "r2",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(second)
+	assert.Nil(t, err, "%s", err)
+	err = storage.RemoveRefresh(previous.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+
+	// rotated token stays invalid after rotation is disabled, but its family isn't revoked
+	storageConfig.RefreshTokenRotation = false
+	storage = New(svc, storageConfig)
+	got, err := storage.LoadRefresh(first.RefreshToken)
+	assert.Equal(t, ErrRefreshTokenReused, err)
+	assert.Nil(t, got)
+	_, err = storage.LoadRefresh(second.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+}
+
+func TestInspect(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("Inspect")
+	storageConfig.RefreshTokenRotation = true
+	storageConfig.RefreshTokenIdleLifetime = time.Hour
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	first := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r1",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now().Add(-2 * time.Hour),
+	}
+	err = storage.SaveAccess(first)
+	assert.Nil(t, err, "%s", err)
+	second := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "2",
+		RefreshToken: "r2",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(second)
+	assert.Nil(t, err, "%s", err)
+	err = storage.RemoveRefresh(first.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	authorizeData := &osin.AuthorizeData{
+		Client:    client,
+		Code:      "9999",
+		ExpiresIn: 60,
+		CreatedAt: time.Now().Add(-time.Hour),
+	}
+	err = storage.SaveAuthorize(authorizeData)
+	assert.Nil(t, err, "%s", err)
+
+	refreshItem := func(token string) map[string]*dynamodb.AttributeValue {
+		resp, err := svc.GetItem(&dynamodb.GetItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				"token": {S: aws.String(token)},
+			},
+			TableName: aws.String(storageConfig.RefreshTable),
+		})
+		assert.Nil(t, err, "%s", err)
+		return resp.Item
+	}
+
+	// rotated and idle refresh tokens are left as they are
+	for _, token := range []string{first.RefreshToken, second.RefreshToken} {
+		before := refreshItem(token)
+		got, err := storage.InspectRefresh(token)
+		assert.Nil(t, err, "%s", err)
+		assert.Equal(t, token, got.RefreshToken)
+		assert.Equal(t, before, refreshItem(token))
+	}
+	_, err = storage.LoadRefresh(second.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+
+	// expired tokens and codes can be inspected
+	_, err = storage.LoadAccess(first.AccessToken)
+	assert.Equal(t, ErrTokenExpired, err)
+	got, err := storage.InspectAccess(first.AccessToken)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, first.AccessToken, got.AccessToken)
+	gotAuthorize, err := storage.InspectAuthorize(authorizeData.Code)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, authorizeData.Code, gotAuthorize.Code)
+
+	_, err = storage.InspectAccess("unknown")
+	assert.Equal(t, ErrAccessNotFound, err)
+}
+
+func TestAuthorize(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("Authorize")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
+	authorizeData := &osin.AuthorizeData{
+		Client:      client,
+		Code:        "9999",
+		ExpiresIn:   3600,
+		RedirectUri: "/dev/null",
+		CreatedAt:   time.Now(),
+	}
+
+	got, err := storage.LoadAuthorize(authorizeData.Code)
+	assert.Equal(t, ErrAuthorizeNotFound, err)
+	assert.Nil(t, got)
+
+	err = storage.SaveAuthorize(authorizeData)
+	assert.Nil(t, err, "%s", err)
+
+	got, err = storage.LoadAuthorize(authorizeData.Code)
+	// We need to convert it to json as pointers inside structs are different
+	// and assert library doesn't provide recursive value comparison for structs
+	assert.Nil(t, err, "%s", err)
+	gotJSON, err := json.Marshal(got)
+	assert.Nil(t, err, "%s", err)
+	expectedJSON, err := json.Marshal(authorizeData)
+	assert.Nil(t, err, "%s", err)
+	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+
+	err = storage.RemoveAuthorize(authorizeData.Code)
+	assert.Nil(t, err, "%s", err)
+
+	got, err = storage.LoadAuthorize(authorizeData.Code)
+	assert.Equal(t, ErrAuthorizeNotFound, err)
+	assert.Nil(t, got)
+
+	// let's try with expired token
+	authorizeData.CreatedAt = authorizeData.CreatedAt.Add(-time.Duration(authorizeData.ExpiresIn) * time.Second)
+	err = storage.SaveAuthorize(authorizeData)
+	assert.Nil(t, err, "%s", err)
+
+	got, err = storage.LoadAuthorize(authorizeData.Code)
+	assert.Equal(t, ErrTokenExpired, err)
+	assert.Nil(t, got)
+}
+
+func TestConsumeAuthorize(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("ConsumeAuthorize")
+	storageConfig.ConsumeAuthorizeOnLoad = true
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	authorizeData := &osin.AuthorizeData{
+		Client:      client,
+		Code:        "9999",
+		ExpiresIn:   3600,
+		RedirectUri: "/dev/null",
+		CreatedAt:   time.Now(),
+	}
+	err = storage.SaveAuthorize(authorizeData)
+	assert.Nil(t, err, "%s", err)
+
+	// concurrent consumers, only one of them should get the code
+	results := make(chan error, 5)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			_, err := storage.ConsumeAuthorize(authorizeData.Code)
+			results <- err
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < cap(results); i++ {
+		err := <-results
+		if err == nil {
+			succeeded++
+		} else {
+			assert.Equal(t, ErrAuthorizeNotFound, err)
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+
+	// LoadAuthorize consumes the code
+	err = storage.SaveAuthorize(authorizeData)
+	assert.Nil(t, err, "%s", err)
+	got, err := storage.LoadAuthorize(authorizeData.Code)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, authorizeData.RedirectUri, got.RedirectUri)
+	got, err = storage.LoadAuthorize(authorizeData.Code)
+	assert.Equal(t, ErrAuthorizeNotFound, err)
+	assert.Nil(t, got)
+}
+
+func TestConditionalWrites(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("ConditionalWrites")
+	storageConfig.ConditionalWrites = true
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
+	err = storage.CreateClient(client)
+	assert.Equal(t, ErrClientExists, err)
+
+	authorizeData := &osin.AuthorizeData{
+		Client:      client,
+		Code:        "9999",
+		ExpiresIn:   3600,
+		RedirectUri: "/dev/null",
+		CreatedAt:   time.Now(),
+	}
+	err = storage.SaveAuthorize(authorizeData)
+	assert.Nil(t, err, "%s", err)
+	err = storage.SaveAuthorize(authorizeData)
+	assert.Equal(t, ErrTokenExists, err)
+
+	accessData := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r1",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
+	err = storage.SaveRefresh(accessData)
+	assert.Equal(t, ErrTokenExists, err)
+
+	// access token collides, refresh token must not be written
+	accessData.RefreshToken = "r2"
+	err = storage.SaveAccess(accessData)
+	assert.Equal(t, ErrTokenExists, err)
+	_, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Equal(t, ErrRefreshNotFound, err)
+
+	accessData.AccessToken = "2"
+	accessData.RefreshToken = ""
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
+	err = storage.SaveAccess(accessData)
+	assert.Equal(t, ErrTokenExists, err)
+}
+
+func TestTimeToLive(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("TimeToLive")
+	storageConfig.RefreshTokenLifetime = 24 * time.Hour
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	accessData := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r9999",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
+
+	resp, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"token": {S: aws.String(accessData.AccessToken)},
+		},
+		TableName: aws.String(storageConfig.AccessTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, strconv.FormatInt(accessData.ExpireAt().Unix(), 10), *resp.Item[DefaultTTLAttribute].N)
+
+	resp, err = svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"token": {S: aws.String(accessData.RefreshToken)},
+		},
+		TableName: aws.String(storageConfig.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	expected := accessData.CreatedAt.Add(storageConfig.RefreshTokenLifetime).Unix()
+	assert.Equal(t, strconv.FormatInt(expected, 10), *resp.Item[DefaultTTLAttribute].N)
+}
+
+func TestHashTokens(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("HashTokens")
+	storageConfig.HashTokens = true
+	storageConfig.TokenPepper = []byte("pepper")
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:     "1234",
+		Secret: "aabbccdd",
+	}
+	accessData := &osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r9999",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	}
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
+
+	// raw token must not be used as a key
+	resp, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"token": {S: aws.String(accessData.RefreshToken)},
+		},
+		TableName: aws.String(storageConfig.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Empty(t, resp.Item)
+
+	resp, err = svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"token": {S: aws.String(storage.hashToken(accessData.RefreshToken))},
+		},
+		TableName: aws.String(storageConfig.RefreshTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.NotContains(t, *resp.Item["json"].S, accessData.RefreshToken)
+	assert.NotContains(t, *resp.Item["json"].S, `"AccessToken":"1"`)
+
+	got, err := storage.LoadAccess(accessData.AccessToken)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, accessData.AccessToken, got.AccessToken)
+
+	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, accessData.RefreshToken, got.RefreshToken)
+
+	// access token is returned as reference which can be used to remove it
+	err = storage.RemoveAccess(got.AccessToken)
+	assert.Nil(t, err, "%s", err)
+	_, err = storage.LoadAccess(accessData.AccessToken)
+	assert.Equal(t, ErrAccessNotFound, err)
+
+	// reference can't be used to load token
+	_, err = storage.LoadRefresh(hashedTokenPrefix + storage.hashToken(accessData.RefreshToken))
+	assert.Equal(t, ErrRefreshNotFound, err)
+}
+
+func TestEncryption(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("Encryption")
 	var err error
 	svc := createDynamoDB()
 	storage := New(svc, storageConfig)
@@ -33,32 +1652,103 @@ func TestClient(t *testing.T) {
 	assert.Nil(t, err, "%s", err)
 	defer storage.DropSchema()
 	client := &osin.DefaultClient{
-		Id:     "1234",
-		Secret: "aabbccdd",
+		Id:          "1234",
+		Secret:      "aabbccdd",
+		RedirectUri: "/dev/null",
 	}
+	// client written before encryption was enabled
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
 
-	got, err := storage.GetClient(client.Id)
-	assert.Equal(t, ErrClientNotFound, err)
-	assert.Nil(t, got)
+	keys := map[string][]byte{
+		"k1": []byte("0123456789abcdef0123456789abcdef"),
+	}
+	storageConfig.Encrypter, err = NewAESGCMKeyring("k1", keys)
+	assert.Nil(t, err, "%s", err)
+	storage = New(svc, storageConfig)
 
-	err = storage.CreateClient(client)
+	authorizeData := &osin.AuthorizeData{
+		Client:      client,
+		Code:        "9999",
+		ExpiresIn:   3600,
+		RedirectUri: "/dev/null",
+		CreatedAt:   time.Now(),
+	}
+	err = storage.SaveAuthorize(authorizeData)
 	assert.Nil(t, err, "%s", err)
 
-	got, err = storage.GetClient(client.Id)
+	resp, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"code": {S: aws.String(authorizeData.Code)},
+		},
+		TableName: aws.String(storageConfig.AuthorizeTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	assert.Nil(t, resp.Item["json"].S)
+	assert.NotContains(t, string(resp.Item["json"].B), "/dev/null")
+
+	got, err := storage.GetClient(client.Id)
 	assert.Nil(t, err, "%s", err)
 	assert.Equal(t, client, got)
 
-	err = storage.RemoveClient(client.Id)
+	// rotate key, items encrypted with k1 must stay readable
+	keys["k2"] = []byte("fedcba9876543210")
+	storageConfig.Encrypter, err = NewAESGCMKeyring("k2", keys)
 	assert.Nil(t, err, "%s", err)
+	storage = New(svc, storageConfig)
 
-	got, err = storage.GetClient(client.Id)
-	assert.Equal(t, ErrClientNotFound, err)
-	assert.Nil(t, got)
+	gotAuthorize, err := storage.LoadAuthorize(authorizeData.Code)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, authorizeData.RedirectUri, gotAuthorize.RedirectUri)
+
+	// ciphertext is bound to its item
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"code":              {S: aws.String("8888")},
+			"json":              resp.Item["json"],
+			DefaultTTLAttribute: resp.Item[DefaultTTLAttribute],
+		},
+		TableName: aws.String(storageConfig.AuthorizeTable),
+	})
+	assert.Nil(t, err, "%s", err)
+	_, err = storage.LoadAuthorize("8888")
+	assert.NotNil(t, err)
+
+	// without keys encrypted items can't be read
+	storageConfig.Encrypter = nil
+	storage = New(svc, storageConfig)
+	_, err = storage.LoadAuthorize(authorizeData.Code)
+	assert.Equal(t, ErrEncrypterNotConfigured, err)
 }
 
-func TestAccess(t *testing.T) {
+func TestAESGCMKeyring(t *testing.T) {
 	t.Parallel()
-	storageConfig := CreateStorageConfig("Access")
+	keyring, err := NewAESGCMKeyring("k1", map[string][]byte{
+		"k1": []byte("0123456789abcdef"),
+	})
+	assert.Nil(t, err, "%s", err)
+
+	ciphertext, err := keyring.Encrypt([]byte("plaintext"), []byte("item"))
+	assert.Nil(t, err, "%s", err)
+	plaintext, err := keyring.Decrypt(ciphertext, []byte("item"))
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, "plaintext", string(plaintext))
+	_, err = keyring.Decrypt(ciphertext, []byte("other item"))
+	assert.NotNil(t, err)
+
+	// ciphertext without version isn't accepted
+	aead, err := keyring.aead("k1")
+	assert.Nil(t, err, "%s", err)
+	header := []byte("\x02k1")
+	nonce := make([]byte, aead.NonceSize())
+	unversioned := aead.Seal(append(append([]byte{}, header...), nonce...), nonce, []byte("plaintext"), header)
+	_, err = keyring.Decrypt(unversioned, []byte("item"))
+	assert.Equal(t, ErrInvalidCiphertext, err)
+}
+
+func TestAttributesEncoding(t *testing.T) {
+	t.Parallel()
+	storageConfig := CreateStorageConfig("AttributesEncoding")
 	storageConfig.CreateUserData = func() interface{} {
 		return &UserDataTest{}
 	}
@@ -69,93 +1759,117 @@ func TestAccess(t *testing.T) {
 	assert.Nil(t, err, "%s", err)
 	defer storage.DropSchema()
 	client := &osin.DefaultClient{
-		Id:     "1234",
-		Secret: "aabbccdd",
+		Id:          "1234",
+		Secret:      "aabbccdd",
+		RedirectUri: "/dev/null",
 	}
+	// items written with json encoding before migration
 	err = storage.CreateClient(client)
 	assert.Nil(t, err, "%s", err)
+	jsonAccessData := &osin.AccessData{
+		Client:      client,
+		AccessToken: "json",
+		ExpiresIn:   3600,
+		CreatedAt:   time.Now(),
+	}
+	err = storage.SaveAccess(jsonAccessData)
+	assert.Nil(t, err, "%s", err)
+
+	storageConfig.Encoding = AttributesEncoding
+	storage = New(svc, storageConfig)
+
+	got, err := storage.GetClient(client.Id)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, client, got)
+	gotAccess, err := storage.LoadAccess(jsonAccessData.AccessToken)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, client, gotAccess.Client)
+
+	authorizeData := &osin.AuthorizeData{
+		Client:      client,
+		Code:        "9999",
+		ExpiresIn:   3600,
+		Scope:       "read",
+		RedirectUri: "/dev/null",
+		State:       "state",
+		CreatedAt:   time.Now(),
+	}
+	err = storage.SaveAuthorize(authorizeData)
+	assert.Nil(t, err, "%s", err)
 	accessData := &osin.AccessData{
-		Client:       client,
-		AccessToken:  "1",
-		RefreshToken: "r9999",
-		ExpiresIn:    3600,
-		CreatedAt:    time.Now(),
+		Client:        client,
+		AuthorizeData: authorizeData,
+		AccessToken:   "1",
+		RefreshToken:  "r1",
+		ExpiresIn:     3600,
+		Scope:         "read",
+		RedirectUri:   "/dev/null",
+		CreatedAt:     time.Now(),
 		UserData: &UserDataTest{
 			Username: "kamil@uniplaces.com",
 		},
 	}
-
-	// When AccessToken is saved, RefreshToken should be saved too, so we check for both
-	got, err := storage.LoadAccess(accessData.AccessToken)
-	assert.Equal(t, ErrAccessNotFound, err)
-	assert.Nil(t, got)
-	got, err = storage.LoadRefresh(accessData.RefreshToken)
-	assert.Equal(t, ErrRefreshNotFound, err)
-	assert.Nil(t, got)
-
-	// We only SaveAccess data
 	err = storage.SaveAccess(accessData)
 	assert.Nil(t, err, "%s", err)
 
-	got, err = storage.LoadAccess(accessData.AccessToken)
-	// We need to convert it to json as pointers inside structs are different
-	// and assert library doesn't provide recursive value comparison for structs
-	assert.Nil(t, err, "%s", err)
-	gotJSON, err := json.Marshal(got)
-	assert.Nil(t, err, "%s", err)
-	expectedJSON, err := json.Marshal(accessData)
+	resp, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"token": {S: aws.String(accessData.AccessToken)},
+		},
+		TableName: aws.String(storageConfig.AccessTable),
+	})
 	assert.Nil(t, err, "%s", err)
-	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+	assert.Nil(t, resp.Item["json"])
+	assert.Equal(t, client.Id, aws.StringValue(resp.Item["client_id"].S))
+	assert.Equal(t, accessData.Scope, aws.StringValue(resp.Item["scope"].S))
+	assert.Equal(t, "3600", aws.StringValue(resp.Item["expires_in"].N))
+	assert.NotNil(t, resp.Item["created_at"])
 
-	got, err = storage.LoadRefresh(accessData.RefreshToken)
-	// We need to convert it to json as pointers inside structs are different
-	// and assert library doesn't provide recursive value comparison for structs
+	gotAuthorize, err := storage.LoadAuthorize(authorizeData.Code)
 	assert.Nil(t, err, "%s", err)
-	gotJSON, err = json.Marshal(got)
+	gotJSON, err := json.Marshal(gotAuthorize)
 	assert.Nil(t, err, "%s", err)
-	expectedJSON, err = json.Marshal(accessData)
+	expectedJSON, err := json.Marshal(authorizeData)
 	assert.Nil(t, err, "%s", err)
 	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
 
-	err = storage.RemoveAccess(accessData.AccessToken)
-	assert.Nil(t, err, "%s", err)
-
-	got, err = storage.LoadAccess(accessData.AccessToken)
-	assert.Equal(t, ErrAccessNotFound, err)
-	assert.Nil(t, got)
-	// RefreshToken should be still there
-	got, err = storage.LoadRefresh(accessData.RefreshToken)
-	// We need to convert it to json as pointers inside structs are different
-	// and assert library doesn't provide recursive value comparison for structs
+	gotAccess, err = storage.LoadAccess(accessData.AccessToken)
 	assert.Nil(t, err, "%s", err)
-	gotJSON, err = json.Marshal(got)
+	gotJSON, err = json.Marshal(gotAccess)
 	assert.Nil(t, err, "%s", err)
 	expectedJSON, err = json.Marshal(accessData)
 	assert.Nil(t, err, "%s", err)
 	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
 
-	// let's try with expired token
-	accessData.CreatedAt = accessData.CreatedAt.Add(-time.Duration(accessData.ExpiresIn) * time.Second)
-	err = storage.SaveAccess(accessData)
+	gotAccess, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	gotJSON, err = json.Marshal(gotAccess)
 	assert.Nil(t, err, "%s", err)
+	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
 
-	got, err = storage.LoadAccess(accessData.AccessToken)
-	assert.Equal(t, ErrTokenExpired, err)
-	assert.Nil(t, got)
-	// refresh token doesn't expire
-	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	// items written with attributes encoding stay readable after rollback
+	storageConfig.Encoding = JSONEncoding
+	storage = New(svc, storageConfig)
+	gotAuthorize, err = storage.LoadAuthorize(authorizeData.Code)
 	assert.Nil(t, err, "%s", err)
-	gotJSON, err = json.Marshal(got)
+	assert.Equal(t, authorizeData.State, gotAuthorize.State)
+	gotAccess, err = storage.LoadAccess(accessData.AccessToken)
 	assert.Nil(t, err, "%s", err)
-	expectedJSON, err = json.Marshal(accessData)
+	assert.Equal(t, accessData.Scope, gotAccess.Scope)
+	gotAccess, err = storage.LoadRefresh(accessData.RefreshToken)
 	assert.Nil(t, err, "%s", err)
-	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+	assert.Equal(t, accessData.AccessToken, gotAccess.AccessToken)
 }
 
-func TestRefresh(t *testing.T) {
+func TestAttributesEncodingEncrypter(t *testing.T) {
 	t.Parallel()
-	storageConfig := CreateStorageConfig("Refresh")
-	var err error
+	storageConfig := CreateStorageConfig("AttributesEncodingEncrypter")
+	keyring, err := NewAESGCMKeyring("k1", map[string][]byte{
+		"k1": []byte("0123456789abcdef"),
+	})
+	assert.Nil(t, err, "%s", err)
+	storageConfig.Encrypter = keyring
+	storageConfig.Encoding = AttributesEncoding
 	svc := createDynamoDB()
 	storage := New(svc, storageConfig)
 	err = storage.CreateSchema()
@@ -165,58 +1879,141 @@ func TestRefresh(t *testing.T) {
 		Id:     "1234",
 		Secret: "aabbccdd",
 	}
+
+	// nothing is written in plaintext
+	err = storage.CreateClient(client)
+	assert.Equal(t, ErrEncryptedAttributes, err)
+	err = storage.SaveAuthorize(&osin.AuthorizeData{
+		Client:    client,
+		Code:      "9999",
+		ExpiresIn: 3600,
+		CreatedAt: time.Now(),
+	})
+	assert.Equal(t, ErrEncryptedAttributes, err)
+	err = storage.SaveAccess(&osin.AccessData{
+		Client:       client,
+		AccessToken:  "1",
+		RefreshToken: "r1",
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	})
+	assert.Equal(t, ErrEncryptedAttributes, err)
+	_, err = storage.UpdateClient(client.Id, 1, ClientUpdate{
+		RedirectUri: aws.String("/dev/null"),
+	})
+	assert.Equal(t, ErrEncryptedAttributes, err)
+	for _, table := range []string{storageConfig.ClientTable, storageConfig.AuthorizeTable, storageConfig.AccessTable, storageConfig.RefreshTable} {
+		resp, err := svc.Scan(&dynamodb.ScanInput{
+			TableName: aws.String(table),
+		})
+		assert.Nil(t, err, "%s", err)
+		assert.Empty(t, resp.Items)
+	}
+}
+
+func TestSingleTable(t *testing.T) {
+	t.Parallel()
+	storageConfig := StorageConfig{
+		SingleTable:         "SingleTable",
+		UserIDAttribute:     "username",
+		CascadeRemoveClient: true,
+		ConditionalWrites:   true,
+		CreateUserData: func() interface{} {
+			return &UserDataTest{}
+		},
+	}
+	var err error
+	svc := createDynamoDB()
+	storage := New(svc, storageConfig)
+	err = storage.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer storage.DropSchema()
+	client := &osin.DefaultClient{
+		Id:          "1234",
+		Secret:      "aabbccdd",
+		RedirectUri: "/dev/null",
+	}
+	err = storage.CreateClient(client)
+	assert.Nil(t, err, "%s", err)
 	err = storage.CreateClient(client)
+	assert.Equal(t, ErrClientExists, err)
+	authorizeData := &osin.AuthorizeData{
+		Client:      client,
+		Code:        "9999",
+		ExpiresIn:   3600,
+		RedirectUri: "/dev/null",
+		CreatedAt:   time.Now(),
+	}
+	err = storage.SaveAuthorize(authorizeData)
 	assert.Nil(t, err, "%s", err)
 	accessData := &osin.AccessData{
 		Client:       client,
 		AccessToken:  "1",
-		RefreshToken: "r9999",
+		RefreshToken: "r1",
 		ExpiresIn:    3600,
 		CreatedAt:    time.Now(),
+		UserData: &UserDataTest{
+			Username: "kamil@uniplaces.com",
+		},
 	}
+	err = storage.SaveAccess(accessData)
+	assert.Nil(t, err, "%s", err)
 
-	got, err := storage.LoadRefresh(accessData.RefreshToken)
-	assert.Equal(t, ErrRefreshNotFound, err)
-	assert.Nil(t, got)
-
-	err = storage.SaveRefresh(accessData)
+	resp, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"pk": {S: aws.String("ACCESS#" + accessData.AccessToken)},
+			"sk": {S: aws.String("ACCESS")},
+		},
+		TableName: aws.String(storageConfig.SingleTable),
+	})
 	assert.Nil(t, err, "%s", err)
+	assert.NotEmpty(t, resp.Item)
 
-	got, err = storage.LoadRefresh(accessData.RefreshToken)
-	// We need to convert it to json as pointers inside structs are different
-	// and assert library doesn't provide recursive value comparison for structs
+	got, err := storage.GetClient(client.Id)
 	assert.Nil(t, err, "%s", err)
-	gotJSON, err := json.Marshal(got)
+	assert.Equal(t, client, got)
+	clients, _, err := storage.ListClients("", 0)
 	assert.Nil(t, err, "%s", err)
-	expectedJSON, err := json.Marshal(accessData)
+	assert.Equal(t, []osin.Client{client}, clients)
+	gotAuthorize, err := storage.LoadAuthorize(authorizeData.Code)
 	assert.Nil(t, err, "%s", err)
-	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
-
-	err = storage.RemoveRefresh(accessData.RefreshToken)
+	assert.Equal(t, authorizeData.RedirectUri, gotAuthorize.RedirectUri)
+	gotAccess, err := storage.LoadAccess(accessData.AccessToken)
 	assert.Nil(t, err, "%s", err)
-
-	got, err = storage.LoadRefresh(accessData.RefreshToken)
-	assert.Equal(t, ErrRefreshNotFound, err)
-	assert.Nil(t, got)
-
-	// let's try with expired token
-	accessData.CreatedAt = accessData.CreatedAt.Add(-time.Duration(accessData.ExpiresIn) * time.Second)
-	err = storage.SaveRefresh(accessData)
+	assert.Equal(t, accessData.UserData, gotAccess.UserData)
+	_, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Nil(t, err, "%s", err)
+	// access and refresh token with the same value don't collide
+	err = storage.SaveRefresh(&osin.AccessData{
+		Client:       client,
+		RefreshToken: accessData.AccessToken,
+		ExpiresIn:    3600,
+		CreatedAt:    time.Now(),
+	})
 	assert.Nil(t, err, "%s", err)
 
-	// refresh token doesn't expire
-	got, err = storage.LoadRefresh(accessData.RefreshToken)
+	err = storage.RevokeUserTokens("kamil@uniplaces.com")
 	assert.Nil(t, err, "%s", err)
-	gotJSON, err = json.Marshal(got)
+	_, err = storage.LoadAccess(accessData.AccessToken)
+	assert.Equal(t, ErrAccessNotFound, err)
+	_, err = storage.LoadRefresh(accessData.RefreshToken)
+	assert.Equal(t, ErrRefreshNotFound, err)
+	_, err = storage.LoadRefresh(accessData.AccessToken)
 	assert.Nil(t, err, "%s", err)
-	expectedJSON, err = json.Marshal(accessData)
+
+	err = storage.RemoveClient(client.Id)
 	assert.Nil(t, err, "%s", err)
-	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+	_, err = storage.GetClient(client.Id)
+	assert.Equal(t, ErrClientNotFound, err)
+	_, err = storage.LoadAuthorize(authorizeData.Code)
+	assert.Equal(t, ErrAuthorizeNotFound, err)
+	_, err = storage.LoadRefresh(accessData.AccessToken)
+	assert.Equal(t, ErrRefreshNotFound, err)
 }
 
-func TestAuthorize(t *testing.T) {
+func TestExportImport(t *testing.T) {
 	t.Parallel()
-	storageConfig := CreateStorageConfig("Authorize")
+	storageConfig := CreateStorageConfig("Export")
 	var err error
 	svc := createDynamoDB()
 	storage := New(svc, storageConfig)
@@ -236,39 +2033,87 @@ func TestAuthorize(t *testing.T) {
 		RedirectUri: "/dev/null",
 		CreatedAt:   time.Now(),
 	}
-
-	got, err := storage.LoadAuthorize(authorizeData.Code)
-	assert.Equal(t, ErrAuthorizeNotFound, err)
-	assert.Nil(t, got)
-
 	err = storage.SaveAuthorize(authorizeData)
 	assert.Nil(t, err, "%s", err)
-
-	got, err = storage.LoadAuthorize(authorizeData.Code)
-	// We need to convert it to json as pointers inside structs are different
-	// and assert library doesn't provide recursive value comparison for structs
+	for i := 0; i < 30; i++ {
+		err = storage.SaveAccess(&osin.AccessData{
+			Client:       client,
+			AccessToken:  "a" + strconv.Itoa(i),
+			RefreshToken: "r" + strconv.Itoa(i),
+			ExpiresIn:    3600,
+			CreatedAt:    time.Now(),
+		})
+		assert.Nil(t, err, "%s", err)
+	}
+	err = storage.SaveAccess(&osin.AccessData{
+		Client:      client,
+		AccessToken: "expired",
+		ExpiresIn:   3600,
+		CreatedAt:   time.Now().Add(-2 * time.Hour),
+	})
 	assert.Nil(t, err, "%s", err)
-	gotJSON, err := json.Marshal(got)
+
+	var buffer bytes.Buffer
+	err = storage.Export(&buffer, ExportOptions{ClientsOnly: true})
 	assert.Nil(t, err, "%s", err)
-	expectedJSON, err := json.Marshal(authorizeData)
+	assert.Equal(t, 1, strings.Count(buffer.String(), "\n"))
+	assert.NotContains(t, buffer.String(), `"B":null`)
+
+	buffer.Reset()
+	err = storage.ExportWithContext(context.Background(), &buffer, ExportOptions{SkipExpired: true})
 	assert.Nil(t, err, "%s", err)
-	assert.JSONEq(t, string(expectedJSON), string(gotJSON))
+	types := map[RecordType]int{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var record Record
+		err = json.Unmarshal([]byte(line), &record)
+		assert.Nil(t, err, "%s", err)
+		types[record.Type]++
+	}
+	assert.Equal(t, map[RecordType]int{
+		RecordClient:    1,
+		RecordAuthorize: 1,
+		RecordAccess:    30,
+		RecordRefresh:   30,
+	}, types)
 
-	err = storage.RemoveAuthorize(authorizeData.Code)
+	// records can be imported to single table
+	target := New(svc, StorageConfig{SingleTable: "ImportSingleTable"})
+	err = target.CreateSchema()
+	assert.Nil(t, err, "%s", err)
+	defer target.DropSchema()
+	err = target.ImportWithContext(context.Background(), &buffer)
 	assert.Nil(t, err, "%s", err)
 
-	got, err = storage.LoadAuthorize(authorizeData.Code)
-	assert.Equal(t, ErrAuthorizeNotFound, err)
-	assert.Nil(t, got)
+	got, err := target.GetClient(client.Id)
+	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, client, got)
+	_, err = target.LoadAuthorize(authorizeData.Code)
+	assert.Nil(t, err, "%s", err)
+	for i := 0; i < 30; i++ {
+		_, err = target.LoadAccess("a" + strconv.Itoa(i))
+		assert.Nil(t, err, "%s", err)
+		_, err = target.LoadRefresh("r" + strconv.Itoa(i))
+		assert.Nil(t, err, "%s", err)
+	}
+	_, err = target.LoadAccess("expired")
+	assert.Equal(t, ErrAccessNotFound, err)
 
-	// let's try with expired token
-	authorizeData.CreatedAt = authorizeData.CreatedAt.Add(-time.Duration(authorizeData.ExpiresIn) * time.Second)
-	err = storage.SaveAuthorize(authorizeData)
+	// repeated key in one batch is written once, the last record wins
+	err = target.Import(strings.NewReader(
+		`{"type":"client","item":{"id":{"S":"5678"},"json":{"S":"{\"Id\":\"5678\",\"Secret\":\"old\"}"}}}` + "\n" +
+			`{"type":"client","item":{"id":{"S":"5678"},"json":{"S":"{\"Id\":\"5678\",\"Secret\":\"new\"}"}}}` + "\n"))
+	assert.Nil(t, err, "%s", err)
+	got, err = target.GetClient("5678")
 	assert.Nil(t, err, "%s", err)
+	assert.Equal(t, "new", got.GetSecret())
 
-	got, err = storage.LoadAuthorize(authorizeData.Code)
-	assert.Equal(t, ErrTokenExpired, err)
-	assert.Nil(t, got)
+	err = target.Import(strings.NewReader(`{"type":"unknown","item":{}}`))
+	assert.Equal(t, ErrInvalidRecord, err)
+}
+
+type ClientTest struct {
+	osin.DefaultClient
+	Scopes []string
 }
 
 type UserDataTest struct {
@@ -282,3 +2127,20 @@ func (receiver UserDataTest) ToAttributeValues() map[string]*dynamodb.AttributeV
 		},
 	}
 }
+
+type DecodedUserDataTest struct {
+	Username string `json:"-"`
+}
+
+func (receiver DecodedUserDataTest) ToAttributeValues() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"username": {
+			S: aws.String(receiver.Username),
+		},
+	}
+}
+
+func (receiver *DecodedUserDataTest) FromAttributeValues(item map[string]*dynamodb.AttributeValue) error {
+	receiver.Username = aws.StringValue(item["username"].S)
+	return nil
+}
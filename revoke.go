@@ -0,0 +1,261 @@
+package osindynamodb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/RangelReale/osin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ClientIndex is the name of global secondary index on client_id attribute
+// of AuthorizeTable, AccessTable and RefreshTable
+const ClientIndex = "client-index"
+
+// ErrUnprocessedItems is returned if DynamoDB keeps returning unprocessed items of BatchWriteItem,
+// e.g. when table is throttled, after maxBatchWriteAttempts
+var ErrUnprocessedItems = errors.New("Unprocessed items left after retries")
+
+// batchWriteLimit is the maximum number of requests in single BatchWriteItem call
+const batchWriteLimit = 25
+
+// maxBatchWriteAttempts is the maximum number of BatchWriteItem calls for the same batch
+const maxBatchWriteAttempts = 8
+
+// RevokeClientTokens deletes all authorization codes, access and refresh tokens issued to the client.
+// This is not a part of interface and as so, it's never used in osin flow.
+// Only items written with client_id attribute are found, items written before it was introduced
+// can be updated with BackfillClientIDs.
+func (receiver *Storage) RevokeClientTokens(clientID string) error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.RevokeClientTokensWithContext(ctx, clientID)
+}
+
+// RevokeClientTokensWithContext is the same as RevokeClientTokens with the ability to pass a context.
+func (receiver *Storage) RevokeClientTokensWithContext(ctx context.Context, clientID string) error {
+	if _, err := receiver.deleteByIndex(ctx, authorizeEntity, ClientIndex, "client_id", clientID); err != nil {
+		return err
+	}
+	if _, err := receiver.deleteByIndex(ctx, accessEntity, ClientIndex, "client_id", clientID); err != nil {
+		return err
+	}
+	if _, err := receiver.deleteByIndex(ctx, refreshEntity, ClientIndex, "client_id", clientID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// BackfillClientIDs adds client_id attribute to authorization codes, access and refresh tokens
+// written without it, so they're found by RevokeClientTokens, and returns number of updated items.
+// Tables are scanned, so it's meant to be run once after upgrade.
+// Expired authorization codes are skipped.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) BackfillClientIDs() (int, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.BackfillClientIDsWithContext(ctx)
+}
+
+// BackfillClientIDsWithContext is the same as BackfillClientIDs with the ability to pass a context.
+func (receiver *Storage) BackfillClientIDsWithContext(ctx context.Context) (int, error) {
+	updated := 0
+	for _, e := range []entity{authorizeEntity, accessEntity, refreshEntity} {
+		params := receiver.exportScan(e, 0, 1)
+		condition := "attribute_not_exists(#client_id)"
+		if params.FilterExpression != nil {
+			condition = *params.FilterExpression + " AND " + condition
+		}
+		params.FilterExpression = aws.String(condition)
+		if params.ExpressionAttributeNames == nil {
+			params.ExpressionAttributeNames = map[string]*string{}
+		}
+		params.ExpressionAttributeNames["#client_id"] = aws.String("client_id")
+
+		var updateErr error
+		err := receiver.db.ScanPagesWithContext(ctx, params, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				var ok bool
+				if ok, updateErr = receiver.backfillClientID(ctx, e, item); updateErr != nil {
+					return false
+				}
+				if ok {
+					updated++
+				}
+			}
+			return true
+		})
+		if err == nil {
+			err = updateErr
+		}
+		if err != nil {
+			return updated, err
+		}
+	}
+
+	return updated, nil
+}
+
+// backfillClientID sets client_id attribute of item of e to id of its client
+// and reports whether item was updated
+func (receiver *Storage) backfillClientID(ctx context.Context, e entity, item map[string]*dynamodb.AttributeValue) (bool, error) {
+	var client osin.Client
+	if e == authorizeEntity {
+		authorizeData, err := receiver.decodeAuthorize(item, "")
+		if err == ErrTokenExpired {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		client = authorizeData.Client
+	} else {
+		accessData, err := receiver.decodeAccess(item, e)
+		if err != nil {
+			return false, err
+		}
+		client = accessData.Client
+	}
+	if client == nil || client.GetId() == "" {
+		return false, nil
+	}
+
+	keyName := e.keyName
+	if receiver.usesSingleTable() {
+		keyName = "pk"
+	}
+	_, err := receiver.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		Key:                 receiver.keyOf(e, item),
+		UpdateExpression:    aws.String("SET #client_id = :client_id"),
+		ConditionExpression: aws.String("attribute_exists(#key)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#client_id": aws.String("client_id"),
+			"#key":       aws.String(keyName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":client_id": {
+				S: aws.String(client.GetId()),
+			},
+		},
+		TableName: receiver.tableName(e),
+	})
+	if isConditionalCheckFailed(err) {
+		// item was deleted meanwhile
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// setClientID adds client_id attribute to item, so it can be found by ClientIndex
+func setClientID(items map[string]*dynamodb.AttributeValue, client osin.Client) {
+	if client == nil || client.GetId() == "" {
+		return
+	}
+	items["client_id"] = &dynamodb.AttributeValue{
+		S: aws.String(client.GetId()),
+	}
+}
+
+// queryKeys returns keys of all items of e having value of attributeName indexed by indexName
+func (receiver *Storage) queryKeys(ctx context.Context, e entity, indexName string, attributeName string, value string) ([]map[string]*dynamodb.AttributeValue, error) {
+	params := receiver.indexQuery(e, indexName, attributeName, value)
+	params.ProjectionExpression = aws.String("pk, sk")
+	if !receiver.usesSingleTable() {
+		params.ProjectionExpression = aws.String("#key")
+		params.ExpressionAttributeNames["#key"] = aws.String(e.keyName)
+	}
+
+	var keys []map[string]*dynamodb.AttributeValue
+	err := receiver.db.QueryPagesWithContext(ctx, params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			keys = append(keys, receiver.keyOf(e, item))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// deleteByIndex deletes all items of e having value of attributeName indexed by indexName
+// and returns number of deleted items
+func (receiver *Storage) deleteByIndex(ctx context.Context, e entity, indexName string, attributeName string, value string) (int, error) {
+	keys, err := receiver.queryKeys(ctx, e, indexName, attributeName, value)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := receiver.batchDelete(ctx, *receiver.tableName(e), keys); err != nil {
+		return 0, err
+	}
+
+	return len(keys), nil
+}
+
+// batchDelete deletes items by keys with BatchWriteItem retrying unprocessed items
+func (receiver *Storage) batchDelete(ctx context.Context, tableName string, keys []map[string]*dynamodb.AttributeValue) error {
+	requests := make([]*dynamodb.WriteRequest, 0, len(keys))
+	for _, key := range keys {
+		requests = append(requests, &dynamodb.WriteRequest{
+			DeleteRequest: &dynamodb.DeleteRequest{
+				Key: key,
+			},
+		})
+	}
+
+	return receiver.batchWrite(ctx, tableName, requests)
+}
+
+// batchWrite executes write requests with BatchWriteItem retrying unprocessed items with exponential backoff
+func (receiver *Storage) batchWrite(ctx context.Context, tableName string, requests []*dynamodb.WriteRequest) error {
+	for len(requests) > 0 {
+		size := len(requests)
+		if size > batchWriteLimit {
+			size = batchWriteLimit
+		}
+		pending := map[string][]*dynamodb.WriteRequest{
+			tableName: requests[:size],
+		}
+		requests = requests[size:]
+
+		for attempt := uint(0); len(pending) > 0; attempt++ {
+			if attempt == maxBatchWriteAttempts {
+				return ErrUnprocessedItems
+			}
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(backoff(attempt)):
+				}
+			}
+
+			resp, err := receiver.db.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: pending,
+			})
+			if err != nil {
+				return err
+			}
+			pending = resp.UnprocessedItems
+		}
+	}
+
+	return nil
+}
+
+// backoff returns exponential delay before retry attempt, limited to about 1 second
+func backoff(attempt uint) time.Duration {
+	if attempt > 5 {
+		attempt = 5
+	}
+	return time.Duration(1<<attempt) * 25 * time.Millisecond
+}
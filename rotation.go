@@ -0,0 +1,88 @@
+package osindynamodb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// FamilyIndex is the name of global secondary index on family attribute
+// of AccessTable and RefreshTable used by refresh token rotation
+const FamilyIndex = "family-index"
+
+// newRefreshFamily returns id of new refresh token family
+func newRefreshFamily() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// rotatedRefreshUpdate marks previous refresh token as rotated in SaveAccess transaction.
+// It fails if the token was already rotated, which means it was reused.
+func (receiver *Storage) rotatedRefreshUpdate(token string, now time.Time) *dynamodb.TransactWriteItem {
+	update := receiver.rotatedUpdate(now)
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			Key:                       receiver.itemKey(refreshEntity, receiver.removeTokenKey(token)),
+			ConditionExpression:       update.ConditionExpression,
+			UpdateExpression:          update.UpdateExpression,
+			ExpressionAttributeNames:  update.ExpressionAttributeNames,
+			ExpressionAttributeValues: update.ExpressionAttributeValues,
+			TableName:                 receiver.tableName(refreshEntity),
+		},
+	}
+}
+
+// tombstoneRefresh marks refresh token as rotated instead of deleting it, so its reuse can be detected
+func (receiver *Storage) tombstoneRefresh(ctx context.Context, token string) error {
+	params := receiver.rotatedUpdate(time.Now())
+	params.Key = receiver.itemKey(refreshEntity, receiver.removeTokenKey(token))
+	params.TableName = receiver.tableName(refreshEntity)
+
+	// token doesn't exist or is already rotated
+	if _, err := receiver.db.UpdateItemWithContext(ctx, params); err != nil && !isConditionalCheckFailed(err) {
+		return err
+	}
+
+	return nil
+}
+
+// rotatedUpdate returns update marking refresh token as rotated at now. Time To Live is set
+// to keep the token for RotatedRefreshTokenLifetime unless it already expires.
+func (receiver *Storage) rotatedUpdate(now time.Time) *dynamodb.UpdateItemInput {
+	lifetime := receiver.config.RotatedRefreshTokenLifetime
+	if lifetime <= 0 {
+		lifetime = DefaultRotatedRefreshTokenLifetime
+	}
+	return &dynamodb.UpdateItemInput{
+		ConditionExpression: aws.String("attribute_exists(#token) AND attribute_not_exists(#rotated_at)"),
+		UpdateExpression:    aws.String("SET #rotated_at = :now, #ttl = if_not_exists(#ttl, :ttl)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#token":      aws.String("token"),
+			"#rotated_at": aws.String("rotated_at"),
+			"#ttl":        aws.String(receiver.ttlAttribute()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": epochValue(now),
+			":ttl": epochValue(now.Add(lifetime)),
+		},
+	}
+}
+
+// revokeRefreshFamily deletes all access and refresh tokens of the family
+func (receiver *Storage) revokeRefreshFamily(ctx context.Context, family string) error {
+	if _, err := receiver.deleteByIndex(ctx, refreshEntity, FamilyIndex, "family", family); err != nil {
+		return err
+	}
+	if _, err := receiver.deleteByIndex(ctx, accessEntity, FamilyIndex, "family", family); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package osindynamodb
+
+import (
+	"context"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// TableOptions allows to configure tables created by CreateSchema.
+// Zero value creates table with provisioned throughput of 1 read and 1 write unit, which is only fit for tests.
+type TableOptions struct {
+	// BillingMode is dynamodb.BillingModeProvisioned or dynamodb.BillingModePayPerRequest.
+	// If empty provisioned mode is used.
+	BillingMode string
+	// ReadCapacityUnits of the table and its indexes in provisioned mode. If zero 1 is used.
+	ReadCapacityUnits int64
+	// WriteCapacityUnits of the table and its indexes in provisioned mode. If zero 1 is used.
+	WriteCapacityUnits int64
+	// SSE enables server-side encryption with AWS KMS
+	SSE bool
+	// KMSMasterKeyID is id, ARN or alias of KMS key used with SSE. If empty AWS managed key is used.
+	KMSMasterKeyID string
+	// PointInTimeRecovery enables continuous backups of the table
+	PointInTimeRecovery bool
+	// StreamViewType enables DynamoDB stream of the table if set, e.g. dynamodb.StreamViewTypeNewAndOldImages
+	StreamViewType string
+	// Tags are added to the table
+	Tags map[string]string
+}
+
+// tableOptions returns options of table tableName
+func (receiver *Storage) tableOptions(tableName string) TableOptions {
+	var options *TableOptions
+	if !receiver.usesSingleTable() {
+		switch tableName {
+		case receiver.config.ClientTable:
+			options = receiver.config.ClientTableOptions
+		case receiver.config.AuthorizeTable:
+			options = receiver.config.AuthorizeTableOptions
+		case receiver.config.AccessTable:
+			options = receiver.config.AccessTableOptions
+		case receiver.config.RefreshTable:
+			options = receiver.config.RefreshTableOptions
+		}
+	}
+	if options != nil {
+		return *options
+	}
+	return receiver.config.TableOptions
+}
+
+// applyTableOptions sets billing mode, throughput, encryption, stream and tags of table definition
+func applyTableOptions(params *dynamodb.CreateTableInput, options TableOptions) {
+	if options.BillingMode == dynamodb.BillingModePayPerRequest {
+		params.BillingMode = aws.String(dynamodb.BillingModePayPerRequest)
+		params.ProvisionedThroughput = nil
+		for _, index := range params.GlobalSecondaryIndexes {
+			index.ProvisionedThroughput = nil
+		}
+	} else {
+		params.ProvisionedThroughput = options.provisionedThroughput()
+		for _, index := range params.GlobalSecondaryIndexes {
+			index.ProvisionedThroughput = options.provisionedThroughput()
+		}
+	}
+
+	if options.SSE {
+		params.SSESpecification = &dynamodb.SSESpecification{
+			Enabled: aws.Bool(true),
+			SSEType: aws.String(dynamodb.SSETypeKms),
+		}
+		if options.KMSMasterKeyID != "" {
+			params.SSESpecification.KMSMasterKeyId = aws.String(options.KMSMasterKeyID)
+		}
+	}
+
+	if options.StreamViewType != "" {
+		params.StreamSpecification = &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(options.StreamViewType),
+		}
+	}
+
+	if len(options.Tags) > 0 {
+		keys := make([]string, 0, len(options.Tags))
+		for key := range options.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			params.Tags = append(params.Tags, &dynamodb.Tag{
+				Key:   aws.String(key),
+				Value: aws.String(options.Tags[key]),
+			})
+		}
+	}
+}
+
+func (receiver TableOptions) provisionedThroughput() *dynamodb.ProvisionedThroughput {
+	throughput := &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(1),
+		WriteCapacityUnits: aws.Int64(1),
+	}
+	if receiver.ReadCapacityUnits > 0 {
+		throughput.ReadCapacityUnits = aws.Int64(receiver.ReadCapacityUnits)
+	}
+	if receiver.WriteCapacityUnits > 0 {
+		throughput.WriteCapacityUnits = aws.Int64(receiver.WriteCapacityUnits)
+	}
+	return throughput
+}
+
+func enablePointInTimeRecovery(ctx context.Context, db dynamodbiface.DynamoDBAPI, tableName string) error {
+	params := &dynamodb.UpdateContinuousBackupsInput{
+		TableName: aws.String(tableName),
+		PointInTimeRecoverySpecification: &dynamodb.PointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: aws.Bool(true),
+		},
+	}
+	if _, err := db.UpdateContinuousBackupsWithContext(ctx, params); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package osindynamodb
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/RangelReale/osin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errInvalidSecretHash is returned by GetClient if secret_hash attribute isn't a string
+var errInvalidSecretHash = errors.New("Client secret hash is not a string")
+
+// HashedSecretClient is returned by GetClient for clients which secret is stored as bcrypt hash.
+// It implements osin.ClientSecretMatcher so osin never needs the raw secret.
+type HashedSecretClient struct {
+	osin.Client
+	// SecretHash is bcrypt hash of client secret
+	SecretHash string
+}
+
+var _ osin.ClientSecretMatcher = (*HashedSecretClient)(nil)
+
+// ClientSecretMatches compares secret with SecretHash
+func (receiver *HashedSecretClient) ClientSecretMatches(secret string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(receiver.SecretHash), []byte(secret)) == nil
+}
+
+// MarshalJSON marshals wrapped client only, so SecretHash is never stored with authorize or access data
+func (receiver *HashedSecretClient) MarshalJSON() ([]byte, error) {
+	return json.Marshal(receiver.Client)
+}
+
+// hashClientSecret returns bcrypt hash of secret
+func (receiver *Storage) hashClientSecret(secret string) (string, error) {
+	cost := receiver.config.ClientSecretCost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// removeClientSecret removes Secret field from json marshaled client
+func removeClientSecret(data []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "Secret")
+	return json.Marshal(fields)
+}
@@ -0,0 +1,173 @@
+package osindynamodb
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// entity describes where and under which key items of one kind are stored
+type entity struct {
+	// keyName is the hash key of entity table. In SingleTable it's kept as a regular attribute.
+	keyName string
+	// prefix is the value of sk and the prefix of pk in SingleTable
+	prefix string
+}
+
+var (
+	clientEntity    = entity{keyName: "id", prefix: "CLIENT"}
+	authorizeEntity = entity{keyName: "code", prefix: "AUTHORIZE"}
+	accessEntity    = entity{keyName: "token", prefix: "ACCESS"}
+	refreshEntity   = entity{keyName: "token", prefix: "REFRESH"}
+)
+
+// usesSingleTable reports whether all entities are stored in StorageConfig.SingleTable
+func (receiver *Storage) usesSingleTable() bool {
+	return receiver.config.SingleTable != ""
+}
+
+// tableName returns name of table holding items of e
+func (receiver *Storage) tableName(e entity) *string {
+	if receiver.usesSingleTable() {
+		return aws.String(receiver.config.SingleTable)
+	}
+	switch e {
+	case clientEntity:
+		return aws.String(receiver.config.ClientTable)
+	case authorizeEntity:
+		return aws.String(receiver.config.AuthorizeTable)
+	case accessEntity:
+		return aws.String(receiver.config.AccessTable)
+	default:
+		return aws.String(receiver.config.RefreshTable)
+	}
+}
+
+// itemKey returns primary key of item of e identified by value
+func (receiver *Storage) itemKey(e entity, value string) map[string]*dynamodb.AttributeValue {
+	if receiver.usesSingleTable() {
+		return map[string]*dynamodb.AttributeValue{
+			"pk": {
+				S: aws.String(e.prefix + "#" + value),
+			},
+			"sk": {
+				S: aws.String(e.prefix),
+			},
+		}
+	}
+	return map[string]*dynamodb.AttributeValue{
+		e.keyName: {
+			S: aws.String(value),
+		},
+	}
+}
+
+// setItemKey adds pk and sk attributes to item of e if SingleTable is used.
+// Value is taken from the attribute named by keyName, which must already be set.
+func (receiver *Storage) setItemKey(items map[string]*dynamodb.AttributeValue, e entity) {
+	if !receiver.usesSingleTable() {
+		return
+	}
+	for k, v := range receiver.itemKey(e, aws.StringValue(items[e.keyName].S)) {
+		items[k] = v
+	}
+}
+
+// keyOf returns key attributes of item of e
+func (receiver *Storage) keyOf(e entity, item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if receiver.usesSingleTable() {
+		return map[string]*dynamodb.AttributeValue{
+			"pk": item["pk"],
+			"sk": item["sk"],
+		}
+	}
+	return map[string]*dynamodb.AttributeValue{
+		e.keyName: item[e.keyName],
+	}
+}
+
+// indexQuery returns query of items of e having value of attributeName indexed by indexName
+func (receiver *Storage) indexQuery(e entity, indexName string, attributeName string, value string) *dynamodb.QueryInput {
+	params := &dynamodb.QueryInput{
+		TableName:              receiver.tableName(e),
+		IndexName:              aws.String(indexName),
+		KeyConditionExpression: aws.String("#attribute = :value"),
+		ExpressionAttributeNames: map[string]*string{
+			"#attribute": aws.String(attributeName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":value": {
+				S: aws.String(value),
+			},
+		},
+	}
+	if receiver.usesSingleTable() {
+		params.KeyConditionExpression = aws.String("#attribute = :value AND #sk = :sk")
+		params.ExpressionAttributeNames["#sk"] = aws.String("sk")
+		params.ExpressionAttributeValues[":sk"] = &dynamodb.AttributeValue{
+			S: aws.String(e.prefix),
+		}
+	}
+	return params
+}
+
+// singleTableSchema returns definition of SingleTable
+func (receiver *Storage) singleTableSchema() *dynamodb.CreateTableInput {
+	params := &dynamodb.CreateTableInput{
+		TableName: aws.String(receiver.config.SingleTable),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("pk"),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			},
+			{
+				AttributeName: aws.String("sk"),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			},
+			{
+				AttributeName: aws.String("family"),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			},
+			{
+				AttributeName: aws.String("client_id"),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("pk"),
+				KeyType:       aws.String("HASH"),
+			},
+			{
+				AttributeName: aws.String("sk"),
+				KeyType:       aws.String("RANGE"),
+			},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			withSortKey(keysOnlyIndex(FamilyIndex, "family")),
+			withSortKey(keysOnlyIndex(ClientIndex, "client_id")),
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	}
+
+	if receiver.config.UserIDAttribute != "" {
+		params.AttributeDefinitions = append(params.AttributeDefinitions, &dynamodb.AttributeDefinition{
+			AttributeName: aws.String(receiver.config.UserIDAttribute),
+			AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+		})
+		params.GlobalSecondaryIndexes = append(params.GlobalSecondaryIndexes, withSortKey(userIndex(receiver.config.UserIDAttribute)))
+	}
+
+	return params
+}
+
+// withSortKey adds sk as range key of index, so items of different entities can be told apart
+func withSortKey(index *dynamodb.GlobalSecondaryIndex) *dynamodb.GlobalSecondaryIndex {
+	index.KeySchema = append(index.KeySchema, &dynamodb.KeySchemaElement{
+		AttributeName: aws.String("sk"),
+		KeyType:       aws.String("RANGE"),
+	})
+	return index
+}
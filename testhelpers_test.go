@@ -6,19 +6,25 @@ import (
 
 	"github.com/RangelReale/osin"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/uniplaces/osin-dynamodb/fakedynamodb"
 )
 
-// createDynamoDB instance
-func createDynamoDB() *dynamodb.DynamoDB {
-	os.Clearenv()
-	os.Setenv("AWS_ACCESS_KEY_ID", "a")     // we use local DynamoDB so we just need to pass any key
-	os.Setenv("AWS_SECRET_ACCESS_KEY", "b") // we use local DynamoDB so we just need to pass any key
+// createDynamoDB instance, in-memory one unless DYNAMODB_ENDPOINT is set,
+// e.g. DYNAMODB_ENDPOINT=http://localhost:4567 to use DynamoDB Local
+func createDynamoDB() dynamodbiface.DynamoDBAPI {
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		return fakedynamodb.New()
+	}
 
 	return dynamodb.New(session.New(&aws.Config{
-		Endpoint: aws.String("http://localhost:4567"),
-		Region:   aws.String("us-west-1"),
+		Endpoint:    aws.String(endpoint),
+		Region:      aws.String("us-west-1"),
+		Credentials: credentials.NewStaticCredentials("a", "b", ""), // we use local DynamoDB so we just need to pass any key
 	}))
 }
 
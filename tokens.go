@@ -0,0 +1,72 @@
+package osindynamodb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/RangelReale/osin"
+)
+
+// hashedTokenPrefix marks token references stored instead of raw values when StorageConfig.HashTokens is enabled
+const hashedTokenPrefix = "sha256:"
+
+// hashToken returns hex encoded SHA-256 (or HMAC-SHA256 if pepper is configured) of the token
+func (receiver *Storage) hashToken(token string) string {
+	if len(receiver.config.TokenPepper) > 0 {
+		mac := hmac.New(sha256.New, receiver.config.TokenPepper)
+		mac.Write([]byte(token))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenKey returns value of hash key under which token, code is stored
+func (receiver *Storage) tokenKey(token string) string {
+	if !receiver.config.HashTokens {
+		return token
+	}
+	return receiver.hashToken(token)
+}
+
+// removeTokenKey is the same as tokenKey but it also accepts token references
+// returned by Load methods in place of tokens which are not known in plaintext
+func (receiver *Storage) removeTokenKey(token string) string {
+	if receiver.config.HashTokens && strings.HasPrefix(token, hashedTokenPrefix) {
+		return strings.TrimPrefix(token, hashedTokenPrefix)
+	}
+	return receiver.tokenKey(token)
+}
+
+// tokenReference returns value stored in json attribute in place of raw token
+func (receiver *Storage) tokenReference(token string) string {
+	if !receiver.config.HashTokens || token == "" {
+		return token
+	}
+	return hashedTokenPrefix + receiver.hashToken(token)
+}
+
+// redactAuthorizeData returns copy of authorizeData without raw code if HashTokens is enabled
+func (receiver *Storage) redactAuthorizeData(authorizeData *osin.AuthorizeData) *osin.AuthorizeData {
+	if !receiver.config.HashTokens || authorizeData == nil {
+		return authorizeData
+	}
+	redacted := *authorizeData
+	redacted.Code = receiver.tokenReference(authorizeData.Code)
+	return &redacted
+}
+
+// redactAccessData returns copy of accessData without raw tokens and codes if HashTokens is enabled
+func (receiver *Storage) redactAccessData(accessData *osin.AccessData) *osin.AccessData {
+	if !receiver.config.HashTokens || accessData == nil {
+		return accessData
+	}
+	redacted := *accessData
+	redacted.AccessToken = receiver.tokenReference(accessData.AccessToken)
+	redacted.RefreshToken = receiver.tokenReference(accessData.RefreshToken)
+	redacted.AuthorizeData = receiver.redactAuthorizeData(accessData.AuthorizeData)
+	redacted.AccessData = receiver.redactAccessData(accessData.AccessData)
+	return &redacted
+}
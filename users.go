@@ -0,0 +1,126 @@
+package osindynamodb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/RangelReale/osin"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// UserIndex is the name of global secondary index on StorageConfig.UserIDAttribute
+// of AccessTable and RefreshTable
+const UserIndex = "user-index"
+
+// ErrUserIndexNotConfigured is returned by RevokeUserTokens and ListUserGrants if UserIDAttribute is empty
+var ErrUserIndexNotConfigured = errors.New("UserIDAttribute not configured")
+
+// Grant is access or refresh token found by ListUserGrants
+type Grant struct {
+	// Refresh is true for refresh tokens and false for access tokens
+	Refresh bool
+	// AccessData of the token. If HashTokens is enabled it holds token references
+	// which can be passed to RemoveAccess or RemoveRefresh.
+	AccessData *osin.AccessData
+}
+
+// RevokeUserTokens deletes all access and refresh tokens of the user across all clients.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) RevokeUserTokens(userID string) error {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.RevokeUserTokensWithContext(ctx, userID)
+}
+
+// RevokeUserTokensWithContext is the same as RevokeUserTokens with the ability to pass a context.
+func (receiver *Storage) RevokeUserTokensWithContext(ctx context.Context, userID string) error {
+	if receiver.config.UserIDAttribute == "" {
+		return ErrUserIndexNotConfigured
+	}
+
+	entities := []entity{
+		accessEntity,
+		refreshEntity,
+	}
+	for i := range entities {
+		if _, err := receiver.deleteByIndex(ctx, entities[i], UserIndex, receiver.config.UserIDAttribute, userID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListUserGrants lists all access and refresh tokens of the user across all clients, including expired ones.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) ListUserGrants(userID string) ([]Grant, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.ListUserGrantsWithContext(ctx, userID)
+}
+
+// ListUserGrantsWithContext is the same as ListUserGrants with the ability to pass a context.
+func (receiver *Storage) ListUserGrantsWithContext(ctx context.Context, userID string) ([]Grant, error) {
+	if receiver.config.UserIDAttribute == "" {
+		return nil, ErrUserIndexNotConfigured
+	}
+
+	var grants []Grant
+	entities := []entity{
+		accessEntity,
+		refreshEntity,
+	}
+	for i := range entities {
+		params := receiver.indexQuery(entities[i], UserIndex, receiver.config.UserIDAttribute, userID)
+
+		refresh := entities[i] == refreshEntity
+		var decodeErr error
+		err := receiver.db.QueryPagesWithContext(ctx, params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				// rotated refresh tokens are kept only to detect reuse
+				if _, rotated := item["rotated_at"]; rotated && refresh {
+					continue
+				}
+				accessData, err := receiver.decodeAccess(item, entities[i])
+				if err != nil {
+					decodeErr = err
+					return false
+				}
+				grants = append(grants, Grant{
+					Refresh:    refresh,
+					AccessData: accessData,
+				})
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+	}
+
+	return grants, nil
+}
+
+// userIndex returns definition of UserIndex on attributeName
+func userIndex(attributeName string) *dynamodb.GlobalSecondaryIndex {
+	return &dynamodb.GlobalSecondaryIndex{
+		IndexName: aws.String(UserIndex),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(attributeName),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		Projection: &dynamodb.Projection{
+			ProjectionType: aws.String(dynamodb.ProjectionTypeAll),
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	}
+}
@@ -0,0 +1,155 @@
+package osindynamodb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// SchemaProblemKind is a kind of mismatch found by Verify
+type SchemaProblemKind string
+
+const (
+	// SchemaProblemMissingTable means table doesn't exist
+	SchemaProblemMissingTable SchemaProblemKind = "MissingTable"
+	// SchemaProblemKeySchema means names or types of table keys differ from expected ones
+	SchemaProblemKeySchema SchemaProblemKind = "KeySchema"
+	// SchemaProblemMissingIndex means global secondary index doesn't exist
+	SchemaProblemMissingIndex SchemaProblemKind = "MissingIndex"
+	// SchemaProblemIndexKeySchema means names or types of index keys differ from expected ones
+	SchemaProblemIndexKeySchema SchemaProblemKind = "IndexKeySchema"
+	// SchemaProblemTimeToLive means Time To Live isn't enabled on TTLAttribute
+	SchemaProblemTimeToLive SchemaProblemKind = "TimeToLive"
+	// SchemaProblemPointInTimeRecovery means point in time recovery required by TableOptions isn't enabled
+	SchemaProblemPointInTimeRecovery SchemaProblemKind = "PointInTimeRecovery"
+)
+
+// SchemaProblem is a mismatch between table and the layout expected by Storage
+type SchemaProblem struct {
+	// Table is the name of table
+	Table string
+	// Kind is the kind of mismatch
+	Kind SchemaProblemKind
+	// Message describes the mismatch
+	Message string
+}
+
+// SchemaReport is the result of Verify
+type SchemaReport struct {
+	// Tables lists names of verified tables
+	Tables []string
+	// Problems lists all mismatches found, empty if schema is as expected
+	Problems []SchemaProblem
+}
+
+// OK reports whether no problems were found
+func (receiver SchemaReport) OK() bool {
+	return len(receiver.Problems) == 0
+}
+
+// Verify checks that every table of StorageConfig exists with keys, indexes and Time To Live
+// expected by Storage and reports what's wrong, so misconfiguration can be found on startup
+// instead of in osin flow. Error is returned only if tables can't be described.
+// This is not a part of interface and as so, it's never used in osin flow.
+func (receiver *Storage) Verify() (SchemaReport, error) {
+	ctx, cancel := receiver.defaultContext()
+	defer cancel()
+	return receiver.VerifyWithContext(ctx)
+}
+
+// VerifyWithContext is the same as Verify with the ability to pass a context.
+func (receiver *Storage) VerifyWithContext(ctx context.Context) (SchemaReport, error) {
+	var report SchemaReport
+	ttlTables := map[string]bool{}
+	for _, tableName := range receiver.ttlTables() {
+		ttlTables[tableName] = true
+	}
+
+	for _, createParams := range receiver.schema() {
+		tableName := *createParams.TableName
+		report.Tables = append(report.Tables, tableName)
+		problem := func(kind SchemaProblemKind, format string, args ...interface{}) {
+			report.Problems = append(report.Problems, SchemaProblem{
+				Table:   tableName,
+				Kind:    kind,
+				Message: fmt.Sprintf(format, args...),
+			})
+		}
+
+		resp, err := receiver.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(tableName),
+		})
+		if isResourceNotFound(err) {
+			problem(SchemaProblemMissingTable, "table %s doesn't exist", tableName)
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+
+		expected := describeKeys(createParams.KeySchema, createParams.AttributeDefinitions)
+		if actual := describeKeys(resp.Table.KeySchema, resp.Table.AttributeDefinitions); actual != expected {
+			problem(SchemaProblemKeySchema, "expected keys %s, got %s", expected, actual)
+		}
+
+		indexes := map[string]*dynamodb.GlobalSecondaryIndexDescription{}
+		for _, index := range resp.Table.GlobalSecondaryIndexes {
+			indexes[aws.StringValue(index.IndexName)] = index
+		}
+		for _, expectedIndex := range createParams.GlobalSecondaryIndexes {
+			index, ok := indexes[*expectedIndex.IndexName]
+			if !ok {
+				problem(SchemaProblemMissingIndex, "index %s doesn't exist", *expectedIndex.IndexName)
+				continue
+			}
+			expected := describeKeys(expectedIndex.KeySchema, createParams.AttributeDefinitions)
+			if actual := describeKeys(index.KeySchema, resp.Table.AttributeDefinitions); actual != expected {
+				problem(SchemaProblemIndexKeySchema, "expected keys %s of index %s, got %s", expected, *expectedIndex.IndexName, actual)
+			}
+		}
+
+		if ttlTables[tableName] {
+			ttl, err := receiver.db.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{
+				TableName: aws.String(tableName),
+			})
+			if err != nil {
+				return report, err
+			}
+			if !timeToLiveEnabled(ttl.TimeToLiveDescription, receiver.ttlAttribute()) {
+				problem(SchemaProblemTimeToLive, "time to live isn't enabled on %s", receiver.ttlAttribute())
+			}
+		}
+
+		if receiver.tableOptions(tableName).PointInTimeRecovery {
+			backups, err := receiver.db.DescribeContinuousBackupsWithContext(ctx, &dynamodb.DescribeContinuousBackupsInput{
+				TableName: aws.String(tableName),
+			})
+			if err != nil {
+				return report, err
+			}
+			if !pointInTimeRecoveryEnabled(backups.ContinuousBackupsDescription) {
+				problem(SchemaProblemPointInTimeRecovery, "point in time recovery isn't enabled")
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// describeKeys formats key schema with attribute types, e.g. "token (HASH, S)"
+func describeKeys(keySchema []*dynamodb.KeySchemaElement, definitions []*dynamodb.AttributeDefinition) string {
+	types := map[string]string{}
+	for _, definition := range definitions {
+		types[aws.StringValue(definition.AttributeName)] = aws.StringValue(definition.AttributeType)
+	}
+
+	keys := make([]string, 0, len(keySchema))
+	for _, key := range keySchema {
+		name := aws.StringValue(key.AttributeName)
+		keys = append(keys, fmt.Sprintf("%s (%s, %s)", name, aws.StringValue(key.KeyType), types[name]))
+	}
+	return strings.Join(keys, ", ")
+}